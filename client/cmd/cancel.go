@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"cr/migrator"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var cancelCmd = &cobra.Command{
+	Use:   "cancel <job>",
+	Short: "cancel a running migration job",
+	Long: `cancel a running migration job, it stops at the next safe point
+and the instance keeps running on the source`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := dialServer()
+		r := migrator.CancelResponse{}
+		err := client.Call("Migrator.Cancel", &migrator.CancelRequest{JobID: args[0]}, &r)
+		client.Close()
+		if err != nil || r.Status != migrator.OK {
+			log.Printf("cancel job %s failed: %v", args[0], err)
+			os.Exit(1)
+		}
+		log.Printf("job %s is being canceled", args[0])
+		job := waitJob(args[0])
+		printJob(&job)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(cancelCmd)
+}
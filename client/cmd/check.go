@@ -0,0 +1,61 @@
+package cmd
+
+import (
+	"cr/migrator"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+
+	"github.com/spf13/cobra"
+)
+
+var checkCmd = &cobra.Command{
+	Use:   "check <instance name> <target IP>",
+	Short: "check that an instance can be migrated to a host",
+	Long: `check that an instance can be migrated to a host without touching
+the container: the target is reachable and compatible, the image exists on
+the target and the target has room for the checkpoint`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		user, err := user.Current()
+		if err != nil {
+			log.Printf("get current user failed: %v", err)
+			os.Exit(1)
+		}
+		diskless, err := cmd.Flags().GetBool("diskless")
+		if err != nil {
+			log.Printf("get diskless flag failed: %v", err)
+			os.Exit(1)
+		}
+		req := &migrator.PreflightRequest{
+			UserName:     user.Username,
+			InstanceName: args[0],
+			Target:       args[1],
+			Mode:         migrator.ModeMigrate,
+		}
+		if diskless {
+			req.Mode = migrator.ModeDiskless
+		}
+		client := dialServer()
+		defer client.Close()
+		r := migrator.PreflightResponse{}
+		err = client.Call("Migrator.Preflight", req, &r)
+		if err != nil {
+			log.Printf("preflight failed: %v", err)
+			os.Exit(1)
+		}
+		if r.Status != migrator.OK {
+			for _, p := range r.Problems {
+				fmt.Printf("FAIL  %s\n", p)
+			}
+			os.Exit(1)
+		}
+		fmt.Printf("OK    instance %s can be migrated to %s\n", args[0], args[1])
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(checkCmd)
+	checkCmd.Flags().BoolP("diskless", "d", false, "check for diskless migration")
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"cr/migrator"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs <job>",
+	Short: "print the command logs of a migration job",
+	Long: `print the output of every command a migration job ran on the source
+and the target, including the criu dump and restore logs`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := dialServer()
+		r := migrator.LogsResponse{}
+		err := client.Call("Migrator.Logs", &migrator.LogsRequest{JobID: args[0]}, &r)
+		client.Close()
+		if err != nil {
+			log.Printf("get logs of job %s failed: %v", args[0], err)
+			os.Exit(1)
+		}
+		for _, f := range r.Files {
+			fmt.Printf("==> %s: %s <==\n", f.Node, f.Name)
+			if f.Truncated {
+				fmt.Printf("[...]\n")
+			}
+			os.Stdout.Write(f.Data)
+			if len(f.Data) > 0 && f.Data[len(f.Data)-1] != '\n' {
+				fmt.Println()
+			}
+			fmt.Println()
+		}
+		for _, p := range r.Problems {
+			log.Printf("%s", p)
+		}
+		if len(r.Files) == 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(logsCmd)
+}
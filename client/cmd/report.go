@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"cr/migrator"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// printReport prints the timings and the traffic of a finished migration
+func printReport(r *migrator.Report) {
+	row := func(name string, d time.Duration) {
+		if d > 0 {
+			fmt.Printf("  %-12s %v\n", name, d)
+		}
+	}
+	fmt.Printf("report:\n")
+	if r.PreDumpRounds > 0 {
+		fmt.Printf("  %-12s %v (%d rounds)\n", "pre-dump", r.PreDump, r.PreDumpRounds)
+	}
+	row("dump", r.Dump)
+	row("stop", r.Stop)
+	row("transfer", r.Transfer)
+	row("page server", r.PageServer)
+	row("image send", r.ImageSend)
+	row("restore", r.Restore)
+	fmt.Printf("  %-12s %v\n", "downtime", r.Downtime)
+	fmt.Printf("  %-12s %v\n", "total", r.Total)
+	fmt.Printf("  %-12s %d\n", "bytes", r.BytesTransferred)
+	if r.Codec != "" && r.BytesTransferred > 0 {
+		fmt.Printf("  %-12s %s, %d bytes before, ratio %.2f\n", "codec", r.Codec, r.BytesRaw, r.CompressionRatio)
+	}
+}
+
+// writeReport writes the report of the job as JSON to path
+func writeReport(path string, job *migrator.Job) error {
+	b, err := json.MarshalIndent(struct {
+		Job    string
+		Result migrator.Status
+		migrator.Report
+	}{job.ID, job.Result, job.Report}, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, append(b, '\n'), 0o644)
+}
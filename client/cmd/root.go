@@ -2,7 +2,9 @@ package cmd
 
 import (
 	"cr/migrator"
+	"cr/transfer"
 	"log"
+	"net"
 	"net/rpc"
 	"os"
 	"os/user"
@@ -10,15 +12,15 @@ import (
 	"github.com/spf13/cobra"
 )
 
-const (
-	localhost = "127.0.0.1"
-)
+// socketPath is where the local server listens
+var socketPath string
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
-	Use:   "migrate",
+	Use:   "migrate <instance name> <target IP>",
 	Short: "migrate an existing container to a new host",
 	Long:  `migrate an existing container to a new host`,
+	Args:  cobra.ExactArgs(2),
 	// Uncomment the following line if your bare application
 	// has an action associated with it:
 	Run: func(cmd *cobra.Command, args []string) {
@@ -36,39 +38,124 @@ var rootCmd = &cobra.Command{
 			log.Printf("get diskless flag failed: %v", err)
 			os.Exit(1)
 		}
-		log.Printf("migrating instance %s to %s", instanceName, targetIP)
-		client, err := rpc.DialHTTP("tcp", localhost+migrator.RPCPort)
+		precopy, err := cmd.Flags().GetBool("precopy")
+		if err != nil {
+			log.Printf("get precopy flag failed: %v", err)
+			os.Exit(1)
+		}
+		postcopy, err := cmd.Flags().GetBool("postcopy")
+		if err != nil {
+			log.Printf("get postcopy flag failed: %v", err)
+			os.Exit(1)
+		}
+		detach, err := cmd.Flags().GetBool("detach")
+		if err != nil {
+			log.Printf("get detach flag failed: %v", err)
+			os.Exit(1)
+		}
+		reportPath, err := cmd.Flags().GetString("report-json")
 		if err != nil {
-			log.Printf("dial http failed: %v", err)
+			log.Printf("get report-json flag failed: %v", err)
 			os.Exit(1)
 		}
+		req := &migrator.StartMigrationRequest{
+			Mode:         migrator.ModeMigrate,
+			UserName:     user.Username,
+			InstanceName: instanceName,
+			Target:       targetIP,
+		}
+		req.Codec, _ = cmd.Flags().GetString("codec")
+		req.Streams, _ = cmd.Flags().GetInt("streams")
+		bwlimit, _ := cmd.Flags().GetString("bwlimit")
+		req.BwLimit, err = transfer.ParseRate(bwlimit)
+		if err != nil {
+			log.Printf("bad bwlimit flag: %v", err)
+			os.Exit(1)
+		}
+		modes := 0
 		if diskless {
-			r := migrator.DisklessMigrateResponse{}
-			err = client.Call("Migrator.DisklessMigrate", &migrator.DisklessMigrateRequest{
-				UserName:     user.Username,
-				InstanceName: instanceName,
-				Target:       targetIP,
-			}, &r)
-			if err != nil || r.Status != migrator.OK {
-				log.Printf("diskless migrate failed: %v", err)
-				os.Exit(1)
-			}
-		} else {
-			r := migrator.MigrateResponse{}
-			err = client.Call("Migrator.Migrate", &migrator.MigrateRequest{
-				UserName:     user.Username,
-				InstanceName: instanceName,
-				Target:       targetIP,
-			}, &r)
-			if err != nil || r.Status != migrator.OK {
-				log.Printf("migrate failed: %v", err)
-				os.Exit(1)
-			}
+			req.Mode = migrator.ModeDiskless
+			modes++
+		}
+		if precopy {
+			req.Mode = migrator.ModePrecopy
+			req.MaxRounds, _ = cmd.Flags().GetInt("max-rounds")
+			req.DirtyThreshold, _ = cmd.Flags().GetInt64("dirty-threshold")
+			req.DirtyThreshold <<= 20
+			req.TimeBudget, _ = cmd.Flags().GetDuration("time-budget")
+			modes++
 		}
+		if postcopy {
+			req.Mode = migrator.ModePostcopy
+			modes++
+		}
+		if modes > 1 {
+			log.Printf("only one of --diskless, --precopy and --postcopy can be used")
+			os.Exit(1)
+		}
+		log.Printf("migrating instance %s to %s", instanceName, targetIP)
+		client := dialServer()
+		r := migrator.StartMigrationResponse{}
+		err = client.Call("Migrator.StartMigration", req, &r)
+		client.Close()
+		if err != nil {
+			log.Printf("%s failed: %v", req.Mode, err)
+			os.Exit(1)
+		}
+		log.Printf("migration started as job %s", r.JobID)
+		if detach {
+			return
+		}
+		job := waitJob(r.JobID)
+		printJobError(&job)
+		printReport(&job.Report)
+		finishJob(&job, reportPath)
 		log.Printf("migrate success")
 	},
 }
 
+// dialServer connects to the local server
+func dialServer() *rpc.Client {
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		log.Printf("connect to server failed: %v", err)
+		os.Exit(1)
+	}
+	return rpc.NewClient(conn)
+}
+
+// finishJob writes the report of a finished job as JSON if reportPath is
+// set, and exits if the migration didn't succeed
+func finishJob(job *migrator.Job, reportPath string) {
+	if job.Done && reportPath != "" {
+		err := writeReport(reportPath, job)
+		if err != nil {
+			log.Printf("write report to %s failed: %v", reportPath, err)
+		}
+	}
+	checkJob(job)
+}
+
+// checkJob exits if the migration didn't succeed
+func checkJob(job *migrator.Job) {
+	if !job.Done {
+		log.Printf("job %s is still running in phase %s", job.ID, job.Phase)
+		os.Exit(2)
+	}
+	switch job.Result {
+	case migrator.OK:
+	case migrator.ROLLEDBACK:
+		log.Printf("%s failed, instance rolled back to the source", job.Mode)
+		os.Exit(1)
+	case migrator.CANCELED:
+		log.Printf("%s canceled", job.Mode)
+		os.Exit(1)
+	default:
+		log.Printf("%s failed", job.Mode)
+		os.Exit(1)
+	}
+}
+
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
@@ -84,9 +171,20 @@ func init() {
 	// will be global for your application.
 
 	// rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "config file (default is $HOME/.cr.yaml)")
+	rootCmd.PersistentFlags().StringVar(&socketPath, "socket", migrator.SocketPath, "unix socket of the local server")
 
 	// Cobra also supports local flags, which will only run
 	// when this action is called directly.
 	rootCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 	rootCmd.Flags().BoolP("diskless", "d", false, "diskless migration")
+	rootCmd.Flags().BoolP("precopy", "p", false, "iterative pre-copy live migration")
+	rootCmd.Flags().Bool("postcopy", false, "post-copy migration, pages are faulted in lazily from the source")
+	rootCmd.Flags().Int("max-rounds", migrator.DefaultMaxRounds, "max pre-dump rounds of pre-copy migration")
+	rootCmd.Flags().Int64("dirty-threshold", migrator.DefaultDirtyThreshold>>20, "dirty set size in MiB under which pre-copy takes the final dump")
+	rootCmd.Flags().Duration("time-budget", migrator.DefaultTimeBudget, "time budget of the pre-dump rounds")
+	rootCmd.Flags().String("codec", "", "codec of the transfers as name[:level], one of none, gzip, zstd, lz4 and auto, the server default if empty")
+	rootCmd.Flags().Int("streams", 0, "connections every transfer is spread over, the server default if zero")
+	rootCmd.Flags().String("bwlimit", "", "bytes per second the migration sends at most, with a K, M or G suffix, the server default if empty")
+	rootCmd.Flags().Bool("detach", false, "print the job ID and return without waiting for the migration")
+	rootCmd.Flags().String("report-json", "", "write the timings of the migration as JSON to this file")
 }
@@ -0,0 +1,93 @@
+package cmd
+
+import (
+	"cr/migrator"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var statusCmd = &cobra.Command{
+	Use:   "status <job>",
+	Short: "show the status of a migration job",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		client := dialServer()
+		defer client.Close()
+		r := migrator.JobStatusResponse{}
+		err := client.Call("Migrator.JobStatus", &migrator.JobStatusRequest{JobID: args[0]}, &r)
+		if err != nil {
+			log.Printf("get status of job %s failed: %v", args[0], err)
+			os.Exit(1)
+		}
+		printJob(&r.Job)
+	},
+}
+
+// printJob prints the phases and the result of a job
+func printJob(job *migrator.Job) {
+	fmt.Printf("job:      %s\n", job.ID)
+	fmt.Printf("mode:     %s\n", job.Mode)
+	fmt.Printf("instance: %s -> %s\n", job.InstanceName, job.Target)
+	fmt.Printf("phase:    %s\n", job.Phase)
+	for _, p := range job.Phases {
+		fmt.Printf("  %s  %s\n", p.Time.Format("2006-01-02 15:04:05.000000"), p.Phase)
+	}
+	if !job.Done {
+		fmt.Printf("result:   running\n")
+		printTransfer(job)
+		return
+	}
+	switch job.Result {
+	case migrator.OK:
+		fmt.Printf("result:   ok\n")
+	case migrator.ROLLEDBACK:
+		fmt.Printf("result:   rolled back\n")
+	case migrator.CANCELED:
+		fmt.Printf("result:   canceled\n")
+	default:
+		fmt.Printf("result:   failed\n")
+	}
+	printJobError(job)
+	printReport(&job.Report)
+}
+
+// printTransfer prints how far the checkpoint sync of a job got
+func printTransfer(job *migrator.Job) {
+	p := job.Transfer
+	if p.TotalFiles == 0 && p.Skipped == 0 {
+		return
+	}
+	fmt.Printf("transfer: %d/%d files, %.1f/%.1f MiB, %d unchanged\n",
+		p.Files, p.TotalFiles, float64(p.Bytes)/(1<<20), float64(p.TotalBytes)/(1<<20), p.Skipped)
+}
+
+// printJobError prints why a finished job didn't succeed
+func printJobError(job *migrator.Job) {
+	if job.Err != nil {
+		printError(job.Err)
+	} else if job.Error != "" {
+		fmt.Printf("error:    %s\n", job.Error)
+	}
+}
+
+// printError prints where a migration failed, following the failures on the
+// peers which caused it
+func printError(e *migrator.Error) {
+	for indent := ""; e != nil; e, indent = e.Cause, indent+"  " {
+		fmt.Printf("%serror:    %s on %s in step %s\n", indent, e.Code, e.Node, e.Step)
+		fmt.Printf("%s          %s\n", indent, e.Message)
+		for _, line := range strings.Split(e.Output, "\n") {
+			if line != "" {
+				fmt.Printf("%s  | %s\n", indent, line)
+			}
+		}
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
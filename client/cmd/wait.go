@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"cr/migrator"
+	"log"
+	"net/rpc"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// waitPoll is how long a single WaitJob call blocks on the server
+	waitPoll = 30 * time.Second
+	// redialDelay is the pause before reconnecting after a dropped connection
+	redialDelay = 2 * time.Second
+)
+
+var waitCmd = &cobra.Command{
+	Use:   "wait <job>",
+	Short: "wait for a migration job to finish",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		reportPath, err := cmd.Flags().GetString("report-json")
+		if err != nil {
+			log.Printf("get report-json flag failed: %v", err)
+			os.Exit(1)
+		}
+		job := waitJob(args[0])
+		printJob(&job)
+		finishJob(&job, reportPath)
+	},
+}
+
+// waitJob polls the server until the job is done. A dropped connection
+// doesn't lose the job, the client dials again and keeps waiting.
+func waitJob(jobID string) migrator.Job {
+	for {
+		client := dialServer()
+		for {
+			r := migrator.JobStatusResponse{}
+			err := client.Call("Migrator.WaitJob", &migrator.WaitJobRequest{
+				JobID:   jobID,
+				Timeout: waitPoll,
+			}, &r)
+			if _, ok := err.(rpc.ServerError); ok {
+				log.Printf("wait for job %s failed: %v", jobID, err)
+				os.Exit(1)
+			}
+			if err != nil {
+				log.Printf("lost connection while waiting for job %s: %v", jobID, err)
+				break
+			}
+			if r.Job.Done {
+				client.Close()
+				return r.Job
+			}
+			if p := r.Job.Transfer; p.TotalFiles > 0 {
+				log.Printf("job %s in phase %s, sent %d/%d files, %d/%d bytes", jobID, r.Job.Phase, p.Files, p.TotalFiles, p.Bytes, p.TotalBytes)
+			} else {
+				log.Printf("job %s in phase %s", jobID, r.Job.Phase)
+			}
+		}
+		client.Close()
+		time.Sleep(redialDelay)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(waitCmd)
+	waitCmd.Flags().String("report-json", "", "write the timings of the migration as JSON to this file")
+}
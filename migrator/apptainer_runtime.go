@@ -0,0 +1,116 @@
+package migrator
+
+import (
+	"context"
+	"cr/apptainer"
+	"cr/util"
+	"os/exec"
+	"time"
+)
+
+// ApptainerRuntime runs containers with the apptainer command line
+type ApptainerRuntime struct{}
+
+// run runs apptainer as userName, it's killed once ctx is done
+func (ApptainerRuntime) run(ctx context.Context, userName string, args ...string) error {
+	return util.RunCmdAsUser(ctx, exec.CommandContext(ctx, "apptainer", args...), userName)
+}
+
+func (ApptainerRuntime) Instance(userName, instanceName string) (*apptainer.File, error) {
+	return apptainer.GetContainerStatus(userName, instanceName)
+}
+
+func (r ApptainerRuntime) Checkpoint(ctx context.Context, userName, instanceName string, opts CheckpointOptions) error {
+	args := []string{"checkpoint", "instance", "--criu"}
+	if opts.PreDump {
+		args = append(args, "--pre-dump")
+	}
+	if opts.ImagesDir != "" {
+		err := util.RunCmdAsUser(ctx, exec.CommandContext(ctx, "mkdir", "-p", opts.ImagesDir), userName)
+		if err != nil {
+			return err
+		}
+		args = append(args, "--images-dir", opts.ImagesDir)
+	}
+	if opts.PrevImagesDir != "" {
+		args = append(args, "--prev-images-dir", opts.PrevImagesDir)
+	}
+	if opts.PreDump || opts.PrevImagesDir != "" {
+		// the next dump needs to know what was dirtied since this one
+		args = append(args, "--track-mem")
+	}
+	if opts.PageServer {
+		args = append(args, "--page-server", "--address", opts.Address)
+	}
+	if opts.LazyPages {
+		args = append(args, "--lazy-pages", "--address", opts.Address)
+	}
+	args = append(args, instanceName)
+	return r.run(ctx, userName, args...)
+}
+
+func (r ApptainerRuntime) Stop(ctx context.Context, userName, instanceName string) error {
+	return r.run(ctx, userName, "instance", "stop", instanceName)
+}
+
+func (r ApptainerRuntime) Restart(ctx context.Context, userName, instanceName, checkpointName, imagePath string, opts RestartOptions) error {
+	args := []string{"instance", "start", "--criu-restart", checkpointName}
+	if opts.LazyPages {
+		args = append(args, "--lazy-pages", "--address", opts.Address)
+	}
+	args = append(args, imagePath, instanceName)
+	return r.run(ctx, userName, args...)
+}
+
+func (r ApptainerRuntime) LaunchPageServer(ctx context.Context, userName, instanceName, checkpointName, imagePath string) error {
+	return r.run(
+		ctx,
+		userName,
+		"instance",
+		"start",
+		"--criu-restart",
+		checkpointName,
+		"--page-server",
+		imagePath,
+		instanceName,
+	)
+}
+
+func (ApptainerRuntime) Restore(ctx context.Context, userName, instanceName string) error {
+	// the restore keeps running with the container, so it must not be
+	// bound to ctx
+	cmd := exec.Command(
+		"apptainer",
+		"checkpoint",
+		"instance",
+		"--criu",
+		"--restore",
+		instanceName,
+	)
+	err := util.AsUser(cmd, userName)
+	if err != nil {
+		return err
+	}
+	wait, err := util.StartCmd(ctx, cmd)
+	if err != nil {
+		return err
+	}
+	// only an early exit tells that the restore failed
+	exited := make(chan error, 1)
+	go func() {
+		_, err := wait()
+		exited <- err
+	}()
+	select {
+	case err = <-exited:
+		return err
+	case <-time.After(restoreGrace):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (r ApptainerRuntime) ConfigureCheckpoint(ctx context.Context, userName, checkpointName, mode string) error {
+	return r.run(ctx, userName, "checkpoint", "config", checkpointName, mode)
+}
@@ -1,17 +1,30 @@
 package migrator
 
+import "time"
+
 type Status int
 
 const (
 	OK Status = iota
 	FAIL
+	// the target failed to take over the instance, it runs on the source again
+	ROLLEDBACK
+	// the migration was canceled, the instance runs on the source
+	CANCELED
 )
 
 const (
 	RPCPort  = ":1234"
 	FilePort = ":1235"
+	// SocketPath is where local clients reach the server
+	SocketPath = "/run/migrator.sock"
 )
 
+// ProtocolVersion is bumped whenever servers of different versions can't
+// migrate between each other. The transfers have a version of their own,
+// transfer.Version.
+const ProtocolVersion = 2
+
 type MigrateRequest struct {
 	UserName     string
 	InstanceName string
@@ -33,32 +46,232 @@ type DisklessMigrateResponse struct {
 }
 
 type LaunchPageServerRequest struct {
+	MigrationID    string
 	UserName       string
 	InstanceName   string
 	CheckpointName string
 	ImagePath      string
+	// Timeout bounds the step on the target, its own default if zero
+	Timeout time.Duration
 }
 
 type LaunchPageServerResponse struct {
 	Status Status
+	// Err is set when Status isn't OK
+	Err *Error
 }
 
 type RestartContainerRequest struct {
+	MigrationID    string
 	UserName       string
 	InstanceName   string
 	CheckpointName string
 	ImagePath      string
+	// Synced tells the source synced the checkpoint natively, Images then
+	// can't be empty
+	Synced bool
+	// Images are the dirs the source synced natively, the target restores
+	// only once it confirmed every one complete
+	Images []string
+	// Timeout bounds the step on the target, its own default if zero
+	Timeout time.Duration
 }
 
 type RestartContainerResponse struct {
 	Status Status
+	// Err is set when Status isn't OK
+	Err *Error
 }
 
 type RestoreRequest struct {
+	MigrationID    string
+	UserName       string
+	InstanceName   string
+	CheckpointName string
+	ImagePath      string
+	// Images are the dirs the source synced natively, the target restores
+	// only once it confirmed every one complete. The images of a diskless
+	// migration always are, so it can't be empty.
+	Images []string
+	// Timeout bounds the step on the target, its own default if zero
+	Timeout time.Duration
+}
+
+type RestoreResponse struct {
+	Status Status
+	// Err is set when Status isn't OK
+	Err *Error
+}
+
+type PrecopyMigrateRequest struct {
 	UserName     string
 	InstanceName string
+	Target       string
+	// convergence policy, zero values fall back to the defaults
+	MaxRounds      int
+	DirtyThreshold int64
+	TimeBudget     time.Duration
 }
 
-type RestoreResponse struct {
+type PrecopyMigrateResponse struct {
+	Status Status
+	Rounds int
+}
+
+type PostcopyMigrateRequest struct {
+	UserName     string
+	InstanceName string
+	Target       string
+}
+
+type PostcopyMigrateResponse struct {
+	Status Status
+}
+
+type LazyRestoreRequest struct {
+	MigrationID    string
+	UserName       string
+	InstanceName   string
+	CheckpointName string
+	ImagePath      string
+	// address of the lazy-pages server on the source node
+	Source string
+	// Synced tells the source synced the checkpoint natively, Images then
+	// can't be empty
+	Synced bool
+	// Images are the dirs the source synced natively, the target restores
+	// only once it confirmed every one complete
+	Images []string
+	// Timeout bounds the step on the target, its own default if zero
+	Timeout time.Duration
+}
+
+type LazyRestoreResponse struct {
+	Status Status
+	// Err is set when Status isn't OK
+	Err *Error
+}
+
+type StopInstanceRequest struct {
+	MigrationID  string
+	UserName     string
+	InstanceName string
+}
+
+type StopInstanceResponse struct {
+	Status Status
+	// Err is set when Status isn't OK
+	Err *Error
+}
+
+type InstanceStatusRequest struct {
+	UserName     string
+	InstanceName string
+}
+
+type InstanceStatusResponse struct {
+	Status  Status
+	Running bool
+}
+
+type StartMigrationRequest struct {
+	// Mode is one of ModeMigrate, ModeDiskless, ModePrecopy and ModePostcopy
+	Mode         string
+	UserName     string
+	InstanceName string
+	Target       string
+	// pre-copy convergence policy
+	MaxRounds      int
+	DirtyThreshold int64
+	TimeBudget     time.Duration
+	// Codec compresses what the migration sends, as "name" or
+	// "name:level", the default of the server if empty
+	Codec string
+	// Streams is how many connections a transfer is spread over, the
+	// default of the server if zero
+	Streams int
+	// BwLimit caps the bytes per second the migration sends, the default of
+	// the server if zero
+	BwLimit int64
+}
+
+type StartMigrationResponse struct {
+	JobID string
+}
+
+type JobStatusRequest struct {
+	JobID string
+}
+
+type JobStatusResponse struct {
+	Job Job
+}
+
+type WaitJobRequest struct {
+	JobID   string
+	Timeout time.Duration
+}
+
+type CancelRequest struct {
+	JobID string
+}
+
+type CancelResponse struct {
+	Status Status
+}
+
+type PreflightRequest struct {
+	UserName     string
+	InstanceName string
+	Target       string
+	Mode         string
+}
+
+type PreflightResponse struct {
 	Status Status
+	// Problems lists every check which failed, empty if the migration can go
+	Problems []string
+}
+
+type TargetCheckRequest struct {
+	Version int
+	// TransferVersion is the version of the transfers of the source
+	TransferVersion int
+	UserName        string
+	InstanceName    string
+	CheckpointName  string
+	ImagePath       string
+	Diskless        bool
+	// Bytes is the estimated size of the checkpoint
+	Bytes int64
+}
+
+type TargetCheckResponse struct {
+	Status          Status
+	Version         int
+	TransferVersion int
+	Problems        []string
+}
+
+type LogsRequest struct {
+	JobID string
+	// UserName, if set, is the owner of the job, the logs must belong to
+	// them
+	UserName string
+	// Local only returns the logs of the node called
+	Local bool
+}
+
+type LogFile struct {
+	Node string
+	Name string
+	Data []byte
+	// Truncated tells that Data is only the end of the file
+	Truncated bool
+}
+
+type LogsResponse struct {
+	Files []LogFile
+	// Problems lists the logs which couldn't be read
+	Problems []string
 }
@@ -0,0 +1,183 @@
+package migrator
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// Local is the service local clients reach over the unix socket. The server
+// learns the uid of the client from the socket, requests run as that user
+// whatever user they name.
+type Local struct {
+	m    *Migrator
+	uid  uint32
+	name string
+}
+
+// Local returns the service for a client running as uid
+func (m *Migrator) Local(uid uint32) (*Local, error) {
+	u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10))
+	if err != nil {
+		return nil, fmt.Errorf("unknown uid %d: %v", uid, err)
+	}
+	return &Local{m: m, uid: uid, name: u.Username}, nil
+}
+
+// user returns the user a request naming userName runs as. Only root may
+// act for another user.
+func (l *Local) user(userName string) (string, error) {
+	if userName == "" || userName == l.name {
+		return l.name, nil
+	}
+	if l.uid != 0 {
+		return "", fmt.Errorf("user %s can't act as user %s", l.name, userName)
+	}
+	return userName, nil
+}
+
+// ownInstance checks that the instance of userName belongs to the client,
+// an instance which doesn't tell its file belongs to root only
+func (l *Local) ownInstance(userName, instanceName string) error {
+	instance, err := l.m.runtime().Instance(userName, instanceName)
+	if err != nil {
+		return err
+	}
+	if l.uid == 0 {
+		return nil
+	}
+	if instance.Path == "" {
+		return fmt.Errorf("can't tell the owner of instance %s", instanceName)
+	}
+	fi, err := os.Stat(instance.Path)
+	if err != nil {
+		return err
+	}
+	if st, ok := fi.Sys().(*syscall.Stat_t); !ok || st.Uid != l.uid {
+		return fmt.Errorf("instance %s doesn't belong to user %s", instanceName, l.name)
+	}
+	return nil
+}
+
+// job returns the job if the client started it
+func (l *Local) job(id string) (*Job, error) {
+	job, err := l.m.getJob(id)
+	if err != nil {
+		return nil, err
+	}
+	if l.uid != 0 && job.UserName != l.name {
+		// don't tell other users which jobs exist
+		return nil, fmt.Errorf("no job %s", id)
+	}
+	return job, nil
+}
+
+func (l *Local) StartMigration(req *StartMigrationRequest, res *StartMigrationResponse) error {
+	userName, err := l.user(req.UserName)
+	if err != nil {
+		return err
+	}
+	err = l.ownInstance(userName, req.InstanceName)
+	if err != nil {
+		log.Printf("refuse migration of %s for user %s: %v", req.InstanceName, l.name, err)
+		return err
+	}
+	req.UserName = userName
+	return l.m.StartMigration(req, res)
+}
+
+func (l *Local) Preflight(req *PreflightRequest, res *PreflightResponse) error {
+	userName, err := l.user(req.UserName)
+	if err != nil {
+		return err
+	}
+	err = l.ownInstance(userName, req.InstanceName)
+	if err != nil {
+		res.Status = FAIL
+		res.Problems = append(res.Problems, err.Error())
+		return nil
+	}
+	req.UserName = userName
+	return l.m.Preflight(req, res)
+}
+
+func (l *Local) JobStatus(req *JobStatusRequest, res *JobStatusResponse) error {
+	if _, err := l.job(req.JobID); err != nil {
+		return err
+	}
+	return l.m.JobStatus(req, res)
+}
+
+func (l *Local) WaitJob(req *WaitJobRequest, res *JobStatusResponse) error {
+	if _, err := l.job(req.JobID); err != nil {
+		return err
+	}
+	return l.m.WaitJob(req, res)
+}
+
+func (l *Local) Cancel(req *CancelRequest, res *CancelResponse) error {
+	if _, err := l.job(req.JobID); err != nil {
+		res.Status = FAIL
+		return err
+	}
+	return l.m.Cancel(req, res)
+}
+
+func (l *Local) Logs(req *LogsRequest, res *LogsResponse) error {
+	job, err := l.job(req.JobID)
+	if err != nil {
+		return err
+	}
+	req.UserName = job.UserName
+	req.Local = false
+	return l.m.Logs(req, res)
+}
+
+// Peer is the service peer servers reach on RPCPort. It only has the steps
+// a source runs on its target, the source checked the user of the request.
+type Peer struct {
+	m *Migrator
+}
+
+// Peer returns the service for peer servers
+func (m *Migrator) Peer() *Peer {
+	return &Peer{m: m}
+}
+
+func (p *Peer) TargetCheck(req *TargetCheckRequest, res *TargetCheckResponse) error {
+	return p.m.TargetCheck(req, res)
+}
+
+func (p *Peer) LaunchPageServer(req *LaunchPageServerRequest, res *LaunchPageServerResponse) error {
+	return p.m.LaunchPageServer(req, res)
+}
+
+func (p *Peer) RestartContainer(req *RestartContainerRequest, res *RestartContainerResponse) error {
+	return p.m.RestartContainer(req, res)
+}
+
+func (p *Peer) Restore(req *RestoreRequest, res *RestoreResponse) error {
+	return p.m.Restore(req, res)
+}
+
+func (p *Peer) LazyRestore(req *LazyRestoreRequest, res *LazyRestoreResponse) error {
+	return p.m.LazyRestore(req, res)
+}
+
+func (p *Peer) StopInstance(req *StopInstanceRequest, res *StopInstanceResponse) error {
+	return p.m.StopInstance(req, res)
+}
+
+func (p *Peer) InstanceStatus(req *InstanceStatusRequest, res *InstanceStatusResponse) error {
+	return p.m.InstanceStatus(req, res)
+}
+
+// Logs only returns the logs on this node, a peer must not make it query
+// yet another node
+func (p *Peer) Logs(req *LogsRequest, res *LogsResponse) error {
+	req.Local = true
+	return p.m.Logs(req, res)
+}
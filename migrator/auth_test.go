@@ -0,0 +1,50 @@
+package migrator
+
+import (
+	"cr/apptainer"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOwnInstance(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to give files away")
+	}
+	const uid = 12345
+	dir := t.TempDir()
+	owned := filepath.Join(dir, "owned.json")
+	other := filepath.Join(dir, "other.json")
+	for _, p := range []string{owned, other} {
+		if err := os.WriteFile(p, nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Chown(owned, uid, uid); err != nil {
+		t.Fatal(err)
+	}
+	rt := NewFakeRuntime()
+	rt.AddInstance("u", apptainer.File{Name: "owned", Path: owned})
+	rt.AddInstance("u", apptainer.File{Name: "other", Path: other})
+	rt.AddInstance("u", apptainer.File{Name: "unknown"})
+	m := &Migrator{Runtime: rt}
+
+	tests := []struct {
+		uid      uint32
+		instance string
+		ok       bool
+	}{
+		{uid, "owned", true},
+		{uid, "other", false},
+		{uid, "unknown", false},
+		{uid, "missing", false},
+		{0, "other", true},
+		{0, "unknown", true},
+	}
+	for _, tt := range tests {
+		l := &Local{m: m, uid: tt.uid, name: "u"}
+		if err := l.ownInstance("u", tt.instance); (err == nil) != tt.ok {
+			t.Errorf("uid %d owns %s: %v, want ok %v", tt.uid, tt.instance, err, tt.ok)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"cr/util"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"reflect"
+	"time"
+)
+
+const (
+	DefaultDumpTimeout       = 10 * time.Minute
+	DefaultStopTimeout       = time.Minute
+	DefaultTransferTimeout   = 30 * time.Minute
+	DefaultConnectTimeout    = 10 * time.Second
+	DefaultPageServerTimeout = 2 * time.Minute
+	DefaultRestoreTimeout    = 5 * time.Minute
+)
+
+// Timeouts bounds the steps of a migration, a zero field uses its default
+type Timeouts struct {
+	// Dump bounds every dump and pre-dump of the container
+	Dump time.Duration
+	Stop time.Duration
+	// Transfer bounds every sync of the checkpoint dir and the image send
+	Transfer time.Duration
+	// Connect bounds dialing a peer and the calls which only query it
+	Connect    time.Duration
+	PageServer time.Duration
+	Restore    time.Duration
+}
+
+func (t Timeouts) of(step string) time.Duration {
+	var d, def time.Duration
+	switch step {
+	case StepDump, StepPreDump:
+		d, def = t.Dump, DefaultDumpTimeout
+	case StepStop:
+		d, def = t.Stop, DefaultStopTimeout
+	case StepTransfer, StepImageSend:
+		d, def = t.Transfer, DefaultTransferTimeout
+	case StepPageServer:
+		d, def = t.PageServer, DefaultPageServerTimeout
+	case StepRestore:
+		d, def = t.Restore, DefaultRestoreTimeout
+	default:
+		d, def = t.Connect, DefaultConnectTimeout
+	}
+	if d <= 0 {
+		return def
+	}
+	return d
+}
+
+// timeoutError is a step killed by its deadline. Commands bound to a context
+// only report the signal which killed them, so it's told by the context.
+type timeoutError struct {
+	step    string
+	timeout time.Duration
+	err     error
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("step %s timed out after %v: %v", e.step, e.timeout, e.err)
+}
+
+func (e *timeoutError) Unwrap() error {
+	return e.err
+}
+
+func (e *timeoutError) Is(target error) bool {
+	return target == context.DeadlineExceeded
+}
+
+// withTimeout bounds step by its timeout. A cancelable step is interrupted
+// by a cancel of the migration too, the others only by the deadline.
+func (mg *migration) withTimeout(step string, cancelable bool) (context.Context, context.CancelFunc) {
+	parent := mg.base
+	if cancelable {
+		parent = mg.ctx
+	}
+	return context.WithTimeout(parent, mg.m.Timeouts.of(step))
+}
+
+// timedOut marks err as a timeout of step if ctx hit its deadline
+func (m *Migrator) timedOut(ctx context.Context, step string, err error) error {
+	if err != nil && errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &timeoutError{step: step, timeout: m.Timeouts.of(step), err: err}
+	}
+	return err
+}
+
+// callContext bounds a call to the target running step. The target bounds
+// the step itself by the same timeout, the call waits a bit longer for the
+// target to report it.
+func (m *Migrator) callContext(step string) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), m.Timeouts.of(step)+m.Timeouts.of(StepConnect))
+}
+
+// peerContext bounds a step the source asked for by the timeout it sent, or
+// by our own if it sent none
+func (mg *migration) peerContext(step string, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		timeout = mg.m.Timeouts.of(step)
+	}
+	return context.WithTimeout(mg.base, timeout)
+}
+
+// Dial connects to the migrator server at addr like rpc.DialHTTP, over TLS
+// if config isn't nil, and gives up once ctx is done
+func Dial(ctx context.Context, addr string, config *tls.Config) (*rpc.Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		tconn := tls.Client(conn, util.TLSClient(config, addr))
+		err = tconn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tconn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	io.WriteString(conn, "CONNECT "+rpc.DefaultRPCPath+" HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return rpc.NewClient(conn), nil
+}
+
+// dialPeer connects to the migrator server on target
+func (m *Migrator) dialPeer(ctx context.Context, target string) (*rpc.Client, error) {
+	return Dial(ctx, target+RPCPort, m.TLS)
+}
+
+// call calls method on the peer and gives up once ctx is done, the peer may
+// still finish the call. The client decodes into a reply of its own, copied
+// to reply once the call is done, so a call given up leaves reply alone.
+func call(ctx context.Context, client *rpc.Client, method string, args interface{}, reply interface{}) error {
+	own := reflect.New(reflect.TypeOf(reply).Elem())
+	c := client.Go(method, args, own.Interface(), make(chan *rpc.Call, 1))
+	select {
+	case <-c.Done:
+		reflect.ValueOf(reply).Elem().Set(own.Elem())
+		return c.Error
+	case <-ctx.Done():
+		return fmt.Errorf("%s: %w", method, ctx.Err())
+	}
+}
+
+// queryPeer dials target and makes a short call on it
+func (m *Migrator) queryPeer(target, method string, args interface{}, reply interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.of(StepConnect))
+	defer cancel()
+	client, err := m.dialPeer(ctx, target)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+	return call(ctx, client, method, args, reply)
+}
@@ -0,0 +1,44 @@
+package migrator
+
+import (
+	"context"
+	"net"
+	"net/rpc"
+	"testing"
+	"time"
+)
+
+type slowService struct{}
+
+func (slowService) Answer(delay time.Duration, reply *Error) error {
+	time.Sleep(delay)
+	*reply = Error{Code: ErrRestoreFailed, Message: "late"}
+	return nil
+}
+
+func TestCallGivenUp(t *testing.T) {
+	server := rpc.NewServer()
+	if err := server.RegisterName("Slow", slowService{}); err != nil {
+		t.Fatal(err)
+	}
+	c1, c2 := net.Pipe()
+	go server.ServeConn(c1)
+	client := rpc.NewClient(c2)
+	defer client.Close()
+
+	var reply Error
+	if err := call(context.Background(), client, "Slow.Answer", time.Duration(0), &reply); err != nil || reply.Code != ErrRestoreFailed {
+		t.Fatalf("call = %v, reply %+v", err, reply)
+	}
+	reply = Error{}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := call(ctx, client, "Slow.Answer", 50*time.Millisecond, &reply); err == nil {
+		t.Fatal("call wasn't given up")
+	}
+	// the late answer must not land in reply, -race tells if it's written
+	time.Sleep(100 * time.Millisecond)
+	if reply.Code != "" {
+		t.Errorf("reply of a call given up = %+v", reply)
+	}
+}
@@ -0,0 +1,141 @@
+package migrator
+
+import (
+	"context"
+	"cr/util"
+	"errors"
+	"fmt"
+	"net/rpc"
+	"os"
+	"strings"
+)
+
+type ErrorCode string
+
+const (
+	ErrInternal         ErrorCode = "internal"
+	ErrInvalidRequest   ErrorCode = "invalid-request"
+	ErrBusy             ErrorCode = "busy"
+	ErrCanceled         ErrorCode = "canceled"
+	ErrTimeout          ErrorCode = "timeout"
+	ErrInstanceNotFound ErrorCode = "instance-not-found"
+	ErrImageNotFound    ErrorCode = "image-not-found"
+	ErrCheckpoint       ErrorCode = "checkpoint-invalid"
+	ErrDumpFailed       ErrorCode = "dump-failed"
+	ErrStopFailed       ErrorCode = "stop-failed"
+	ErrTransferFailed   ErrorCode = "transfer-failed"
+	ErrUnreachable      ErrorCode = "unreachable"
+	ErrPageServerFailed ErrorCode = "page-server-failed"
+	ErrRestoreFailed    ErrorCode = "restore-failed"
+	ErrImagesIncomplete ErrorCode = "images-incomplete"
+	ErrRemote           ErrorCode = "remote-failed"
+)
+
+// Steps of a migration, an Error tells in which one it failed
+const (
+	StepQueue      = "queue"
+	StepLookup     = "lookup"
+	StepPreDump    = "pre-dump"
+	StepDump       = "dump"
+	StepStop       = "stop"
+	StepTransfer   = "transfer"
+	StepConnect    = "connect"
+	StepPageServer = "page-server"
+	StepImageSend  = "image-send"
+	StepRestore    = "restore"
+)
+
+// Error is a migration failure as reported to clients. It travels in the
+// responses rather than as the error of the RPC, net/rpc only keeps the
+// text of those.
+type Error struct {
+	Code ErrorCode
+	// Step is the step of the migration which failed
+	Step string
+	// Node is the host the failure happened on
+	Node    string
+	Message string
+	// Output is the output of the failed command, if any
+	Output string
+	// Cause is the failure on the peer which made this one fail
+	Cause *Error
+}
+
+func (e *Error) Error() string {
+	msg := fmt.Sprintf("%s on %s in step %s: %s", e.Code, e.Node, e.Step, e.Message)
+	if e.Cause != nil {
+		msg += ": " + e.Cause.Error()
+	}
+	return msg
+}
+
+var hostname = func() string {
+	name, err := os.Hostname()
+	if err != nil {
+		return "unknown"
+	}
+	return name
+}()
+
+// newError wraps err as a failure of this node in step
+func newError(code ErrorCode, step string, err error) *Error {
+	var e *Error
+	if errors.As(err, &e) {
+		return e
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		code = ErrTimeout
+	}
+	e = &Error{
+		Code:    code,
+		Step:    step,
+		Node:    hostname,
+		Message: err.Error(),
+	}
+	var cmdErr *util.CommandError
+	if errors.As(err, &cmdErr) {
+		e.Output = strings.TrimSpace(cmdErr.Output)
+	}
+	return e
+}
+
+// remoteError is the failure of an RPC to target in step. callErr is the
+// error of the call itself, remote the failure the target reported.
+func remoteError(code ErrorCode, step, target string, callErr error, remote *Error) *Error {
+	if callErr != nil {
+		// only a ServerError comes from the handler on the target, anything
+		// else is the connection
+		if _, ok := callErr.(rpc.ServerError); !ok {
+			return newError(ErrUnreachable, step, fmt.Errorf("call to %s failed: %w", target, callErr))
+		}
+		remote = &Error{Code: ErrRemote, Step: step, Node: target, Message: callErr.Error()}
+	}
+	if remote == nil {
+		remote = &Error{Code: ErrRemote, Step: step, Node: target, Message: "failed without details"}
+	}
+	return &Error{
+		Code:    code,
+		Step:    step,
+		Node:    hostname,
+		Message: fmt.Sprintf("target %s failed", target),
+		Cause:   remote,
+	}
+}
+
+// fail records the first failure of the migration and returns it
+func (mg *migration) fail(code ErrorCode, step string, err error) *Error {
+	e := newError(code, step, err)
+	if mg.err == nil {
+		mg.err = e
+	}
+	return e
+}
+
+// failRemote records a failure of the target and returns it
+func (mg *migration) failRemote(code ErrorCode, step string, callErr error, remote *Error) *Error {
+	e := remoteError(code, step, mg.entry.Target, callErr, remote)
+	if mg.err == nil {
+		mg.err = e
+	}
+	return e
+}
@@ -0,0 +1,198 @@
+package migrator
+
+import (
+	"context"
+	"cr/apptainer"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FakeRuntime is an in-memory ContainerRuntime for tests. Instances are
+// plain records, Calls returns every call made and Errors makes the named
+// method fail, e.g. Errors["Restart"]. A checkpoint into an images dir
+// writes a pages image there of the size PreDumpPages gives for its round,
+// the last one repeating. A lazy checkpoint writes the inventory into the
+// checkpoint dir and serves pages until PagesServed is closed. Errors,
+// PreDumpPages and PagesServed must be set before use.
+type FakeRuntime struct {
+	mu        sync.Mutex
+	instances map[string]*apptainer.File
+	// pageServers holds the instances waiting for a Restore
+	pageServers  map[string]*apptainer.File
+	calls        []string
+	preDumps     int
+	Errors       map[string]error
+	PreDumpPages []int64
+	PagesServed  chan struct{}
+}
+
+func NewFakeRuntime() *FakeRuntime {
+	return &FakeRuntime{
+		instances:   make(map[string]*apptainer.File),
+		pageServers: make(map[string]*apptainer.File),
+		Errors:      make(map[string]error),
+	}
+}
+
+// AddInstance makes the instance run
+func (f *FakeRuntime) AddInstance(userName string, instance apptainer.File) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance.User = userName
+	f.instances[instanceKey(userName, instance.Name)] = &instance
+}
+
+// Calls returns the calls made so far, as the method name followed by its
+// arguments
+func (f *FakeRuntime) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// call logs the call and returns the error configured for method, f.mu
+// must be held
+func (f *FakeRuntime) call(method string, args ...interface{}) error {
+	f.calls = append(f.calls, strings.TrimSpace(fmt.Sprintln(append([]interface{}{method}, args...)...)))
+	return f.Errors[method]
+}
+
+func (f *FakeRuntime) Instance(userName, instanceName string) (*apptainer.File, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	instance, ok := f.instances[instanceKey(userName, instanceName)]
+	if !ok {
+		return nil, fmt.Errorf("no instance found with name %s", instanceName)
+	}
+	c := *instance
+	return &c, nil
+}
+
+func (f *FakeRuntime) Checkpoint(ctx context.Context, userName, instanceName string, opts CheckpointOptions) error {
+	f.mu.Lock()
+	if opts.LazyPages {
+		err := f.lazyCheckpoint(userName, instanceName, opts)
+		f.mu.Unlock()
+		if err != nil {
+			return err
+		}
+		select {
+		case <-f.PagesServed:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	defer f.mu.Unlock()
+	if err := f.call("Checkpoint", instanceName, opts); err != nil {
+		return err
+	}
+	if _, ok := f.instances[instanceKey(userName, instanceName)]; !ok {
+		return fmt.Errorf("no instance found with name %s", instanceName)
+	}
+	if opts.ImagesDir == "" {
+		return nil
+	}
+	var pages int64
+	if len(f.PreDumpPages) > 0 {
+		pages = f.PreDumpPages[len(f.PreDumpPages)-1]
+		if f.preDumps < len(f.PreDumpPages) {
+			pages = f.PreDumpPages[f.preDumps]
+		}
+	}
+	f.preDumps++
+	err := os.MkdirAll(opts.ImagesDir, 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(opts.ImagesDir, "pages-1.img"), make([]byte, pages), 0o644)
+}
+
+// lazyCheckpoint writes the minimal dump of a lazy checkpoint, f.mu must be
+// held
+func (f *FakeRuntime) lazyCheckpoint(userName, instanceName string, opts CheckpointOptions) error {
+	if err := f.call("Checkpoint", instanceName, opts); err != nil {
+		return err
+	}
+	instance, ok := f.instances[instanceKey(userName, instanceName)]
+	if !ok {
+		return fmt.Errorf("no instance found with name %s", instanceName)
+	}
+	checkpointDir, err := apptainer.GetCheckpointDir(userName, instance.Checkpoint)
+	if err != nil {
+		return err
+	}
+	imgDir := filepath.Join(checkpointDir, "img")
+	err = os.MkdirAll(imgDir, 0o755)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(imgDir, "inventory.img"), nil, 0o644)
+}
+
+func (f *FakeRuntime) Stop(ctx context.Context, userName, instanceName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("Stop", instanceName); err != nil {
+		return err
+	}
+	key := instanceKey(userName, instanceName)
+	delete(f.instances, key)
+	delete(f.pageServers, key)
+	return nil
+}
+
+func (f *FakeRuntime) Restart(ctx context.Context, userName, instanceName, checkpointName, imagePath string, opts RestartOptions) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("Restart", instanceName, checkpointName, imagePath, opts); err != nil {
+		return err
+	}
+	f.instances[instanceKey(userName, instanceName)] = &apptainer.File{
+		Name:       instanceName,
+		User:       userName,
+		Image:      imagePath,
+		Checkpoint: checkpointName,
+	}
+	return nil
+}
+
+func (f *FakeRuntime) LaunchPageServer(ctx context.Context, userName, instanceName, checkpointName, imagePath string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("LaunchPageServer", instanceName, checkpointName, imagePath); err != nil {
+		return err
+	}
+	f.pageServers[instanceKey(userName, instanceName)] = &apptainer.File{
+		Name:       instanceName,
+		User:       userName,
+		Image:      imagePath,
+		Checkpoint: checkpointName,
+	}
+	return nil
+}
+
+func (f *FakeRuntime) Restore(ctx context.Context, userName, instanceName string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.call("Restore", instanceName); err != nil {
+		return err
+	}
+	key := instanceKey(userName, instanceName)
+	instance, ok := f.pageServers[key]
+	if !ok {
+		return fmt.Errorf("no page server launched for instance %s", instanceName)
+	}
+	delete(f.pageServers, key)
+	f.instances[key] = instance
+	return nil
+}
+
+func (f *FakeRuntime) ConfigureCheckpoint(ctx context.Context, userName, checkpointName, mode string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.call("ConfigureCheckpoint", checkpointName, mode)
+}
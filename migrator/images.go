@@ -0,0 +1,182 @@
+package migrator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// imagesTTL is how long the transfers of a migration are tracked
+const imagesTTL = time.Hour
+
+// imageSession is a transfer session of a migration to this node, it's in
+// flight until the file server confirmed the tree it sent or found it
+// incomplete
+type imageSession struct {
+	user    string
+	started time.Time
+	// name is the tree the session committed or failed to
+	name      string
+	committed bool
+	err       error
+}
+
+// TransferStarted records a session of a migration syncing to this node
+func (m *Migrator) TransferStarted(migration, user, session string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	if m.images == nil {
+		m.images = make(map[string]map[string]*imageSession)
+	}
+	for id, sessions := range m.images {
+		for key, s := range sessions {
+			if now.Sub(s.started) > imagesTTL {
+				delete(sessions, key)
+			}
+		}
+		if len(sessions) == 0 {
+			delete(m.images, id)
+		}
+	}
+	if m.images[migration] == nil {
+		m.images[migration] = make(map[string]*imageSession)
+	}
+	m.images[migration][session] = &imageSession{user: user, started: now}
+	m.imagesChanged()
+}
+
+// TransferCommitted records that the file server confirmed the tree at
+// name complete
+func (m *Migrator) TransferCommitted(migration, user, session, name string) {
+	m.endTransfer(migration, session, name, nil)
+}
+
+// TransferFailed records that the file server found the tree at name
+// incomplete
+func (m *Migrator) TransferFailed(migration, user, session, name string, err error) {
+	m.endTransfer(migration, session, name, err)
+}
+
+func (m *Migrator) endTransfer(migration, session, name string, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.images[migration][session]
+	if !ok {
+		return
+	}
+	s.name = filepath.Clean(name)
+	s.committed = err == nil
+	s.err = err
+	m.imagesChanged()
+}
+
+// imagesChanged wakes up the restores waiting for images, m.mu must be held
+func (m *Migrator) imagesChanged() {
+	if m.imagesWait != nil {
+		close(m.imagesWait)
+		m.imagesWait = nil
+	}
+}
+
+// imagesComplete tells whether every dir of dirs was committed by a session
+// of the migration for userName, and if not whether a session still in
+// flight may do it
+func (m *Migrator) imagesComplete(migration, userName string, dirs []string) (bool, bool, error) {
+	sessions := m.images[migration]
+	if len(sessions) == 0 {
+		return false, false, fmt.Errorf("no images of migration %s reached %s", migration, hostname)
+	}
+	inFlight := false
+	for _, s := range sessions {
+		if s.user == userName && !s.committed && s.err == nil {
+			inFlight = true
+		}
+	}
+	var missing []string
+	var failure error
+	for _, dir := range dirs {
+		dir = filepath.Clean(dir)
+		done := false
+		for _, s := range sessions {
+			if s.user != userName || s.name != dir {
+				continue
+			}
+			if s.committed {
+				done = true
+			} else if s.err != nil {
+				failure = s.err
+			}
+		}
+		if !done {
+			missing = append(missing, dir)
+		}
+	}
+	if len(missing) == 0 {
+		// a sync still in flight may change what was committed
+		return !inFlight, inFlight, nil
+	}
+	err := fmt.Errorf("images of migration %s in %s aren't complete", migration, strings.Join(missing, ", "))
+	if failure != nil {
+		err = fmt.Errorf("%w: %v", err, failure)
+	}
+	return false, inFlight, err
+}
+
+// errNoImages is a restore of images synced natively which lists none
+var errNoImages = errors.New("the source synced no images")
+
+// waitImages returns once the dirs the source synced for the migration are
+// confirmed complete on this node. It waits while a sync of the migration is
+// in flight and fails right away if none may complete them. If the source
+// synced natively, it must have synced some dirs.
+func (m *Migrator) waitImages(ctx context.Context, migration, userName string, synced bool, dirs []string) error {
+	if len(dirs) == 0 {
+		if synced {
+			return fmt.Errorf("images of migration %s: %w", migration, errNoImages)
+		}
+		return nil
+	}
+	logged := false
+	for {
+		m.mu.Lock()
+		ok, inFlight, err := m.imagesComplete(migration, userName, dirs)
+		if ok {
+			m.mu.Unlock()
+			return nil
+		}
+		if !inFlight {
+			m.mu.Unlock()
+			return err
+		}
+		if m.imagesWait == nil {
+			m.imagesWait = make(chan struct{})
+		}
+		wait := m.imagesWait
+		m.mu.Unlock()
+		if !logged {
+			log.Printf("wait for the images of migration %s to be complete", migration)
+			logged = true
+		}
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return fmt.Errorf("images of migration %s are still in transit: %w", migration, ctx.Err())
+		}
+	}
+}
+
+// synced records that the target confirmed dir complete, the target
+// restores only once it has every dir recorded
+func (mg *migration) synced(dir string) {
+	for _, d := range mg.images {
+		if d == dir {
+			return
+		}
+	}
+	mg.images = append(mg.images, dir)
+}
@@ -0,0 +1,255 @@
+package migrator
+
+import (
+	"context"
+	"cr/transfer"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// jobRetention is how long a finished job can still be queried
+	jobRetention = 24 * time.Hour
+	// maxWaitTimeout bounds a single WaitJob call, clients wait longer by
+	// calling it again
+	maxWaitTimeout = time.Minute
+)
+
+type PhaseTime struct {
+	Phase Phase
+	Time  time.Time
+}
+
+// Job is a migration started on this node as seen by clients
+type Job struct {
+	ID           string
+	Mode         string
+	UserName     string
+	InstanceName string
+	Target       string
+	// Phase is the latest phase the migration reached
+	Phase  Phase
+	Phases []PhaseTime
+	Done   bool
+	// Result, Error, Err and Report are only valid once Done
+	Result Status
+	Error  string
+	// Err tells where and why the migration failed, it is set for
+	// rollbacks too
+	Err    *Error
+	Report Report
+	// Transfer is how far the latest checkpoint sync got
+	Transfer transfer.Progress
+
+	finished chan struct{}
+	cancel   context.CancelFunc
+}
+
+// snapshot returns a copy of the job, the caller must hold the migrator lock
+func (j *Job) snapshot() Job {
+	c := *j
+	c.Phases = append([]PhaseTime(nil), j.Phases...)
+	c.finished = nil
+	c.cancel = nil
+	return c
+}
+
+// addJob registers the job of a migration started on this node
+func (m *Migrator) addJob(job *Job) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jobs == nil {
+		m.jobs = make(map[string]*Job)
+	}
+	for id, j := range m.jobs {
+		if j.Done && len(j.Phases) > 0 && time.Since(j.Phases[len(j.Phases)-1].Time) > jobRetention {
+			delete(m.jobs, id)
+		}
+	}
+	m.jobs[job.ID] = job
+}
+
+func (m *Migrator) getJob(id string) (*Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job, ok := m.jobs[id]
+	if !ok {
+		return nil, fmt.Errorf("no job %s", id)
+	}
+	return job, nil
+}
+
+// jobTransfer records how far the checkpoint sync of the job got
+func (m *Migrator) jobTransfer(job *Job, p transfer.Progress) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.Transfer = p
+}
+
+// jobPhase records that the job reached phase p at t
+func (m *Migrator) jobPhase(job *Job, p Phase, t time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.Phase = p
+	job.Phases = append(job.Phases, PhaseTime{Phase: p, Time: t})
+}
+
+// completeJob records the outcome of the job and wakes up its waiters
+func (m *Migrator) completeJob(job *Job, status Status, err *Error, report Report) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	job.Done = true
+	job.Result = status
+	job.Err = err
+	job.Report = report
+	switch {
+	case status == OK:
+	case status == ROLLEDBACK && err != nil:
+		job.Error = "rolled back to the source: " + err.Error()
+	case err != nil:
+		job.Error = err.Error()
+	case status == CANCELED:
+		job.Error = "migration canceled, the instance runs on the source"
+	case status == ROLLEDBACK:
+		job.Error = "target failed to take over the instance, rolled back to the source"
+	case status != OK:
+		job.Error = "migration failed, see the server log"
+	}
+	close(job.finished)
+	job.cancel()
+}
+
+// runMigration runs the flow of req.Mode for mg
+func (m *Migrator) runMigration(mg *migration, req *StartMigrationRequest) (Status, error) {
+	switch req.Mode {
+	case ModeMigrate:
+		r := MigrateResponse{}
+		err := m.migrate(mg, &MigrateRequest{
+			UserName:     req.UserName,
+			InstanceName: req.InstanceName,
+			Target:       req.Target,
+		}, &r)
+		return r.Status, err
+	case ModeDiskless:
+		r := DisklessMigrateResponse{}
+		err := m.disklessMigrate(mg, &DisklessMigrateRequest{
+			UserName:     req.UserName,
+			InstanceName: req.InstanceName,
+			Target:       req.Target,
+		}, &r)
+		return r.Status, err
+	case ModePrecopy:
+		r := PrecopyMigrateResponse{}
+		err := m.precopyMigrate(mg, &PrecopyMigrateRequest{
+			UserName:       req.UserName,
+			InstanceName:   req.InstanceName,
+			Target:         req.Target,
+			MaxRounds:      req.MaxRounds,
+			DirtyThreshold: req.DirtyThreshold,
+			TimeBudget:     req.TimeBudget,
+		}, &r)
+		return r.Status, err
+	case ModePostcopy:
+		r := PostcopyMigrateResponse{}
+		err := m.postcopyMigrate(mg, &PostcopyMigrateRequest{
+			UserName:     req.UserName,
+			InstanceName: req.InstanceName,
+			Target:       req.Target,
+		}, &r)
+		return r.Status, err
+	}
+	return FAIL, fmt.Errorf("unknown migration mode %q", req.Mode)
+}
+
+// StartMigration starts a migration in the background and returns its job
+// right away
+func (m *Migrator) StartMigration(req *StartMigrationRequest, res *StartMigrationResponse) error {
+	if req.Mode == "" {
+		req.Mode = ModeMigrate
+	}
+	switch req.Mode {
+	case ModeMigrate, ModeDiskless, ModePrecopy, ModePostcopy:
+	default:
+		return fmt.Errorf("unknown migration mode %q", req.Mode)
+	}
+	codec := m.codec()
+	if req.Codec != "" {
+		var err error
+		codec, err = transfer.ParseCodec(req.Codec)
+		if err != nil {
+			return err
+		}
+	}
+	mg, err := m.beginMigration(req.Mode, req.UserName, req.InstanceName, req.Target)
+	if err != nil {
+		return err
+	}
+	mg.codec = codec
+	if req.Streams > 0 {
+		mg.streams = req.Streams
+	}
+	if req.BwLimit > 0 {
+		mg.bwlimit = req.BwLimit
+	}
+	go func() {
+		status, err := m.runMigration(mg, req)
+		mg.finish(status, err)
+		log.Printf("job %s finished with status %v", mg.entry.ID, status)
+	}()
+	res.JobID = mg.entry.ID
+	return nil
+}
+
+func (m *Migrator) JobStatus(req *JobStatusRequest, res *JobStatusResponse) error {
+	job, err := m.getJob(req.JobID)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res.Job = job.snapshot()
+	return nil
+}
+
+// WaitJob blocks until the job is done or the timeout expires, whichever
+// comes first, and returns the job
+func (m *Migrator) WaitJob(req *WaitJobRequest, res *JobStatusResponse) error {
+	job, err := m.getJob(req.JobID)
+	if err != nil {
+		return err
+	}
+	timeout := req.Timeout
+	if timeout <= 0 || timeout > maxWaitTimeout {
+		timeout = maxWaitTimeout
+	}
+	select {
+	case <-job.finished:
+	case <-time.After(timeout):
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	res.Job = job.snapshot()
+	return nil
+}
+
+// Cancel asks a running migration to stop at its next safe point. Transfers
+// in flight are killed, what the target set up is torn down and the instance
+// is kept on or restarted on the source.
+func (m *Migrator) Cancel(req *CancelRequest, res *CancelResponse) error {
+	job, err := m.getJob(req.JobID)
+	if err != nil {
+		res.Status = FAIL
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if job.Done {
+		res.Status = FAIL
+		return fmt.Errorf("job %s already finished", req.JobID)
+	}
+	log.Printf("cancel job %s in phase %s", job.ID, job.Phase)
+	job.cancel()
+	res.Status = OK
+	return nil
+}
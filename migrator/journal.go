@@ -0,0 +1,342 @@
+package migrator
+
+import (
+	"bufio"
+	"context"
+	"cr/transfer"
+	"cr/util"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+type Phase string
+
+const (
+	PhaseQueued             Phase = "queued"
+	PhaseStarted            Phase = "started"
+	PhaseDumped             Phase = "dumped"
+	PhaseSourceStopped      Phase = "source-stopped"
+	PhaseTransferred        Phase = "transferred"
+	PhasePageServerLaunched Phase = "page-server-launched"
+	PhaseRestarted          Phase = "restarted"
+	PhaseDone               Phase = "done"
+	PhaseFailed             Phase = "failed"
+	PhaseRolledBack         Phase = "rolled-back"
+	PhaseCanceled           Phase = "canceled"
+)
+
+// finished reports whether nothing is left to do for a migration in phase p
+func (p Phase) finished() bool {
+	return p == PhaseDone || p == PhaseFailed || p == PhaseRolledBack || p == PhaseCanceled
+}
+
+const (
+	ModeMigrate  = "migrate"
+	ModeDiskless = "diskless"
+	ModePrecopy  = "precopy"
+	ModePostcopy = "postcopy"
+)
+
+const (
+	RoleSource = "source"
+	RoleTarget = "target"
+)
+
+// JournalEntry records a phase transition of a migration on this node
+type JournalEntry struct {
+	ID           string    `json:"id"`
+	Time         time.Time `json:"time"`
+	Role         string    `json:"role"`
+	Mode         string    `json:"mode"`
+	UserName     string    `json:"user"`
+	InstanceName string    `json:"instance"`
+	Target       string    `json:"target,omitempty"`
+	Checkpoint   string    `json:"checkpoint,omitempty"`
+	Image        string    `json:"image,omitempty"`
+	Phase        Phase     `json:"phase"`
+}
+
+// Journal is an append-only log of migration phases, every entry is synced
+// to disk before the migration moves on.
+type Journal struct {
+	mu   sync.Mutex
+	path string
+	file *os.File
+}
+
+func OpenJournal(path string) (*Journal, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0o700)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	return &Journal{path: path, file: file}, nil
+}
+
+// Record appends e to the journal and syncs it. Once e ends its migration
+// the journal is rewritten with the migrations still running only, so it
+// doesn't grow with every migration the node ever ran.
+func (j *Journal) Record(e JournalEntry) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	_, err = j.file.Write(append(b, '\n'))
+	if err != nil {
+		return err
+	}
+	if err := j.file.Sync(); err != nil {
+		return err
+	}
+	if !e.Phase.finished() {
+		return nil
+	}
+	// e is on disk, a failed compaction only leaves the journal longer
+	entries, err := j.unfinished()
+	if err == nil {
+		err = j.compact(entries)
+	}
+	if err != nil {
+		log.Printf("failed to compact journal %s: %v", j.path, err)
+	}
+	return nil
+}
+
+// Unfinished returns the latest entry of every migration which didn't reach
+// a final phase
+func (j *Journal) Unfinished() ([]JournalEntry, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.unfinished()
+}
+
+// unfinished is Unfinished with j.mu held
+func (j *Journal) unfinished() ([]JournalEntry, error) {
+	f, err := os.Open(j.path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var order []string
+	latest := make(map[string]JournalEntry)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var e JournalEntry
+		// a torn last line is what a crash in the middle of a write leaves
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			log.Printf("skip corrupted journal entry: %v", err)
+			continue
+		}
+		key := e.Role + "/" + e.ID
+		if _, ok := latest[key]; !ok {
+			order = append(order, key)
+		}
+		latest[key] = e
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	var entries []JournalEntry
+	for _, key := range order {
+		if e := latest[key]; !e.Phase.finished() {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// Compact rewrites the journal so that it only holds the given entries
+func (j *Journal) Compact(entries []JournalEntry) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.compact(entries)
+}
+
+// compact is Compact with j.mu held
+func (j *Journal) compact(entries []JournalEntry) error {
+	// the new journal is kept open to append to once it replaced the old
+	// one, so the journal never ends up without a file to write to
+	tmp := j.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, e := range entries {
+		err = enc.Encode(e)
+		if err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, j.path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	j.file.Close()
+	j.file = f
+	// the rename only lasts once the directory is synced
+	return syncDir(filepath.Dir(j.path))
+}
+
+func syncDir(path string) error {
+	d, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	err = d.Sync()
+	if cerr := d.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (j *Journal) Close() error {
+	return j.file.Close()
+}
+
+// migration tracks the phases of one migration on this node
+type migration struct {
+	m     *Migrator
+	entry JournalEntry
+	// job is nil on the target
+	job *Job
+	// ctx is done once the migration is canceled, child processes which are
+	// safe to kill are bound to it
+	ctx context.Context
+	// base is ctx without the cancel, for the steps a cancel must not
+	// interrupt. Both carry the log dir of the migration.
+	base context.Context
+	// locked and outbound tell what release has to give back
+	locked   bool
+	outbound bool
+
+	// codec compresses what the migration sends over streams connections,
+	// at most bwlimit bytes per second if not zero
+	codec    transfer.Codec
+	streams  int
+	bwlimit  int64
+	report   Report
+	started  time.Time
+	frozenAt time.Time
+	// images are the dirs the target confirmed complete
+	images []string
+	// err is the first failure of the migration
+	err *Error
+}
+
+// newMigration tracks a migration, an empty id starts a new one. The first
+// phase is left to the caller, a target may pick up a migration it already
+// journaled.
+func (m *Migrator) newMigration(id, role, mode, userName, instanceName, target string) *migration {
+	if id == "" {
+		id = util.NewID()
+	}
+	base := m.logContext(context.Background(), id, userName)
+	mg := &migration{
+		m:       m,
+		ctx:     base,
+		base:    base,
+		codec:   m.codec(),
+		streams: m.streams(),
+		bwlimit: m.MigrationBwLimit,
+		report:  Report{Mode: mode},
+		started: time.Now(),
+		entry: JournalEntry{
+			ID:           id,
+			Role:         role,
+			Mode:         mode,
+			UserName:     userName,
+			InstanceName: instanceName,
+			Target:       target,
+		},
+	}
+	if role == RoleSource {
+		var cancel context.CancelFunc
+		mg.ctx, cancel = context.WithCancel(base)
+		mg.job = &Job{
+			ID:           id,
+			Mode:         mode,
+			UserName:     userName,
+			InstanceName: instanceName,
+			Target:       target,
+			finished:     make(chan struct{}),
+			cancel:       cancel,
+		}
+		m.addJob(mg.job)
+	}
+	return mg
+}
+
+// setInstance remembers what the source needs to roll back the instance
+func (mg *migration) setInstance(checkpoint, image string) {
+	mg.entry.Checkpoint = checkpoint
+	mg.entry.Image = image
+}
+
+func (mg *migration) phase(p Phase) {
+	mg.entry.Phase = p
+	mg.entry.Time = time.Now()
+	if mg.job != nil {
+		mg.m.jobPhase(mg.job, p, mg.entry.Time)
+	}
+	if mg.m.Journal == nil {
+		return
+	}
+	err := mg.m.Journal.Record(mg.entry)
+	if err != nil {
+		log.Printf("failed to journal phase %s of migration %s: %v", p, mg.entry.ID, err)
+	}
+}
+
+// progress records how far a checkpoint sync got
+func (mg *migration) progress(p transfer.Progress) {
+	log.Printf("migration %s sent %d/%d files, %d/%d bytes", mg.entry.ID, p.Files, p.TotalFiles, p.Bytes, p.TotalBytes)
+	if mg.job != nil {
+		mg.m.jobTransfer(mg.job, p)
+	}
+}
+
+// finish records the final phase matching status and completes the job
+func (mg *migration) finish(status Status, err error) {
+	switch status {
+	case OK:
+		mg.phase(PhaseDone)
+	case ROLLEDBACK:
+		mg.phase(PhaseRolledBack)
+	case CANCELED:
+		mg.phase(PhaseCanceled)
+	default:
+		mg.phase(PhaseFailed)
+	}
+	mg.release()
+	mg.collectCriuLogs()
+	mg.report.Total = time.Since(mg.started)
+	if mg.err == nil && err != nil {
+		mg.err = newError(ErrInternal, string(mg.entry.Phase), err)
+	}
+	if mg.job != nil {
+		mg.m.completeJob(mg.job, status, mg.err, mg.report)
+	}
+}
+
+// canceled reports whether the migration should stop at this safe point
+func (mg *migration) canceled() bool {
+	return mg.ctx.Err() != nil
+}
@@ -0,0 +1,67 @@
+package migrator
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestJournalCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "journal")
+	j, err := OpenJournal(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer j.Close()
+	record := func(id string, phases ...Phase) {
+		for _, p := range phases {
+			if err := j.Record(JournalEntry{ID: id, Role: RoleSource, Phase: p}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	record("a", PhaseStarted, PhaseDumped)
+	record("b", PhaseStarted, PhaseDumped, PhaseDone)
+	record("c", PhaseStarted)
+	record("a", PhaseSourceStopped)
+
+	entries, err := j.Unfinished()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 || entries[0].ID != "a" || entries[0].Phase != PhaseSourceStopped || entries[1].ID != "c" {
+		t.Errorf("unfinished = %+v, want a in %s and c", entries, PhaseSourceStopped)
+	}
+	// b finishing kept a and c at their latest phase, a moved on since
+	if n := countLines(t, path); n != 3 {
+		t.Errorf("journal holds %d entries, want 3", n)
+	}
+	record("a", PhaseRolledBack)
+	record("c", PhaseFailed)
+	if n := countLines(t, path); n != 0 {
+		t.Errorf("journal holds %d entries once all migrations ended, want 0", n)
+	}
+	// the entries after a compaction go to the new journal
+	record("d", PhaseStarted)
+	if n := countLines(t, path); n != 1 {
+		t.Errorf("journal holds %d entries after a new one, want 1", n)
+	}
+	if _, err := os.Stat(path + ".tmp"); !os.IsNotExist(err) {
+		t.Errorf("compaction left its temporary file: %v", err)
+	}
+}
+
+func countLines(t *testing.T, path string) int {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	n := 0
+	for s := bufio.NewScanner(f); s.Scan(); {
+		n++
+	}
+	return n
+}
@@ -0,0 +1,175 @@
+package migrator
+
+import (
+	"context"
+	"cr/transfer"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	DefaultMaxOutbound = 2
+	DefaultMaxInbound  = 2
+)
+
+// initLimits sets up the migration slots the first time they're needed
+func (m *Migrator) initLimits() {
+	m.limitsOnce.Do(func() {
+		if m.MaxOutbound <= 0 {
+			m.MaxOutbound = DefaultMaxOutbound
+		}
+		if m.MaxInbound <= 0 {
+			m.MaxInbound = DefaultMaxInbound
+		}
+		m.outbound = make(chan struct{}, m.MaxOutbound)
+		m.inbound = make(chan struct{}, m.MaxInbound)
+		m.locks = make(map[string]string)
+		m.inboundHolders = make(map[string]*time.Timer)
+		m.bandwidth = transfer.NewLimiter(m.BwLimit)
+	})
+}
+
+// share joins a transfer capped at rate bytes per second on its own to the
+// bandwidth of the node
+func (m *Migrator) share(rate int64) *transfer.Share {
+	m.initLimits()
+	return m.bandwidth.Share(rate)
+}
+
+func instanceKey(userName, instanceName string) string {
+	return userName + "/" + instanceName
+}
+
+// beginMigration starts tracking a migration of an instance from this node,
+// it fails right away if the instance is already being migrated
+func (m *Migrator) beginMigration(mode, userName, instanceName, target string) (*migration, error) {
+	m.initLimits()
+	key := instanceKey(userName, instanceName)
+	m.mu.Lock()
+	if id, ok := m.locks[key]; ok {
+		m.mu.Unlock()
+		return nil, fmt.Errorf("instance %s of user %s is already being migrated by job %s", instanceName, userName, id)
+	}
+	// reserve the instance before the job exists, the id is set below
+	m.locks[key] = ""
+	m.mu.Unlock()
+
+	mg := m.newMigration("", RoleSource, mode, userName, instanceName, target)
+	m.mu.Lock()
+	m.locks[key] = mg.entry.ID
+	m.mu.Unlock()
+	mg.locked = true
+	return mg, nil
+}
+
+// start waits for an outbound slot and records the start of the migration,
+// it gives up if the migration is canceled while queued
+func (mg *migration) start() error {
+	m := mg.m
+	m.initLimits()
+	select {
+	case m.outbound <- struct{}{}:
+	default:
+		log.Printf("migration %s queued, %d outbound migrations running", mg.entry.ID, m.MaxOutbound)
+		mg.phase(PhaseQueued)
+		select {
+		case m.outbound <- struct{}{}:
+		case <-mg.ctx.Done():
+			return fmt.Errorf("migration %s canceled while queued", mg.entry.ID)
+		}
+	}
+	mg.outbound = true
+	mg.phase(PhaseStarted)
+	return nil
+}
+
+// acquireInbound waits for an inbound slot for the migration until ctx is
+// done, a migration holds at most one slot however many requests the source
+// sends. The request which gets it owns it until the migration finishes.
+func (m *Migrator) acquireInbound(ctx context.Context, id string) error {
+	m.initLimits()
+	m.mu.Lock()
+	if m.holdInbound(id) {
+		m.mu.Unlock()
+		return nil
+	}
+	select {
+	case m.inbound <- struct{}{}:
+		m.inboundHolders[id] = nil
+		m.mu.Unlock()
+		return nil
+	default:
+	}
+	m.mu.Unlock()
+	log.Printf("inbound migration %s queued, %d inbound migrations running", id, m.MaxInbound)
+	select {
+	case m.inbound <- struct{}{}:
+	case <-ctx.Done():
+		return fmt.Errorf("no inbound slot for migration %s: %w", id, ctx.Err())
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.holdInbound(id) {
+		// another request of the migration got one meanwhile
+		<-m.inbound
+	} else {
+		m.inboundHolders[id] = nil
+	}
+	return nil
+}
+
+// holdInbound tells whether the migration holds an inbound slot and takes
+// it over from the timer of an earlier request, m.mu must be held
+func (m *Migrator) holdInbound(id string) bool {
+	t, ok := m.inboundHolders[id]
+	if ok && t != nil {
+		t.Stop()
+		m.inboundHolders[id] = nil
+	}
+	return ok
+}
+
+// keepInbound leaves the inbound slot of the migration to its next request,
+// it's given back if none comes within ttl as the source abandoned it
+func (m *Migrator) keepInbound(id string, ttl time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.inboundHolders[id]; !ok {
+		return
+	}
+	var t *time.Timer
+	t = time.AfterFunc(ttl, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if m.inboundHolders[id] != t {
+			return
+		}
+		log.Printf("inbound migration %s abandoned, release its slot", id)
+		delete(m.inboundHolders, id)
+		<-m.inbound
+	})
+	m.inboundHolders[id] = t
+}
+
+// release frees the instance lock and the slots held by the migration
+func (mg *migration) release() {
+	m := mg.m
+	if mg.outbound {
+		mg.outbound = false
+		<-m.outbound
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if mg.locked {
+		mg.locked = false
+		delete(m.locks, instanceKey(mg.entry.UserName, mg.entry.InstanceName))
+	}
+	if t, ok := m.inboundHolders[mg.entry.ID]; ok {
+		if t != nil {
+			t.Stop()
+		}
+		delete(m.inboundHolders, mg.entry.ID)
+		<-m.inbound
+	}
+}
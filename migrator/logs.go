@@ -0,0 +1,180 @@
+package migrator
+
+import (
+	"context"
+	"cr/apptainer"
+	"cr/util"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"syscall"
+)
+
+const (
+	// maxLogSize bounds each log file returned by Logs, from its end
+	maxLogSize = 1 << 20
+)
+
+// validMigrationID checks that id, which may come from a peer, names a
+// single entry of the log dir
+func validMigrationID(id string) error {
+	if id == "" || filepath.Base(id) != id || id == "." || id == ".." {
+		return fmt.Errorf("invalid migration id %q", id)
+	}
+	return nil
+}
+
+// logContext returns ctx with the log dir of migration id of userName, the
+// output of the commands run with it is kept there. It's ctx itself if
+// logging is off or id is invalid.
+func (m *Migrator) logContext(ctx context.Context, id, userName string) context.Context {
+	if m.LogDir == "" {
+		return ctx
+	}
+	if err := validMigrationID(id); err != nil {
+		log.Printf("no log dir for migration: %v", err)
+		return ctx
+	}
+	d, err := util.NewLogDir(filepath.Join(m.LogDir, id), userName)
+	if err != nil {
+		log.Printf("failed to create log dir of migration %s: %v", id, err)
+		return ctx
+	}
+	return util.WithLogDir(ctx, d)
+}
+
+// collectCriuLogs copies the logs criu left in the checkpoint dir, e.g.
+// dump.log and restore.log, into the log dir of the migration
+func (mg *migration) collectCriuLogs() {
+	d := util.LogDirFrom(mg.base)
+	if d == nil || mg.entry.Checkpoint == "" {
+		return
+	}
+	checkpointDir, err := apptainer.GetCheckpointDir(mg.entry.UserName, mg.entry.Checkpoint)
+	if err != nil {
+		return
+	}
+	dirs := []string{checkpointDir}
+	if imgDir, err := apptainer.GetImageRealPath(checkpointDir); err == nil {
+		dirs = append(dirs, imgDir)
+	}
+	for _, dir := range dirs {
+		logs, _ := filepath.Glob(filepath.Join(dir, "*.log"))
+		for _, path := range logs {
+			err := copyLog(path, d, "criu-"+filepath.Base(path))
+			if err != nil {
+				log.Printf("failed to collect criu log %s: %v", path, err)
+			}
+		}
+	}
+}
+
+// copyLog copies the log at src, which the user may have replaced with
+// anything, to name in d
+func copyLog(src string, d *util.LogDir, name string) error {
+	in, err := os.OpenFile(src, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s isn't a regular file", src)
+	}
+	out, err := d.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// readLogs returns the log files of migration id on this node, they must
+// belong to userName unless it's empty
+func (m *Migrator) readLogs(id, userName string) ([]LogFile, error) {
+	if m.LogDir == "" {
+		return nil, fmt.Errorf("logging is off on %s", hostname)
+	}
+	if err := validMigrationID(id); err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(m.LogDir, id)
+	if userName != "" {
+		if err := ownsLogs(dir, userName); err != nil {
+			return nil, err
+		}
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []LogFile
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		f := LogFile{Node: hostname, Name: e.Name()}
+		f.Data, f.Truncated, err = util.ReadTail(filepath.Join(dir, e.Name()), maxLogSize)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].Name < files[j].Name })
+	return files, nil
+}
+
+// ownsLogs checks the log dir at dir belongs to userName
+func ownsLogs(dir, userName string) error {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return err
+	}
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !info.IsDir() || !ok || strconv.FormatUint(uint64(st.Uid), 10) != u.Uid {
+		return fmt.Errorf("logs of %s don't belong to user %s", filepath.Base(dir), userName)
+	}
+	return nil
+}
+
+// Logs returns the command logs of a migration. On the source they include
+// those of the target, unless Local is set.
+func (m *Migrator) Logs(req *LogsRequest, res *LogsResponse) error {
+	files, err := m.readLogs(req.JobID, req.UserName)
+	if err != nil {
+		res.Problems = append(res.Problems, fmt.Sprintf("no logs on %s: %v", hostname, err))
+	}
+	res.Files = append(res.Files, files...)
+	if req.Local {
+		return nil
+	}
+	job, err := m.getJob(req.JobID)
+	if err != nil {
+		res.Problems = append(res.Problems, fmt.Sprintf("don't know the target of %s: %v", req.JobID, err))
+		return nil
+	}
+	r := LogsResponse{}
+	err = m.queryPeer(job.Target, "Migrator.Logs", &LogsRequest{JobID: req.JobID, UserName: req.UserName, Local: true}, &r)
+	if err != nil {
+		res.Problems = append(res.Problems, fmt.Sprintf("can't get logs of target %s: %v", job.Target, err))
+		return nil
+	}
+	res.Files = append(res.Files, r.Files...)
+	res.Problems = append(res.Problems, r.Problems...)
+	return nil
+}
@@ -0,0 +1,55 @@
+package migrator
+
+import (
+	"context"
+	"cr/util"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLogs(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &Migrator{LogDir: t.TempDir()}
+	ctx := m.logContext(context.Background(), "m1", u.Username)
+	if err := util.RunCmd(ctx, exec.Command("echo", "hello")); err != nil {
+		t.Fatal(err)
+	}
+	dir := filepath.Join(m.LogDir, "m1")
+	info, err := os.Stat(dir)
+	if err != nil || info.Mode().Perm() != 0o700 {
+		t.Fatalf("log dir: %v, %v", info, err)
+	}
+	// a symlink the user left in their log dir isn't followed
+	secret := filepath.Join(t.TempDir(), "secret")
+	os.WriteFile(secret, []byte("secret"), 0o600)
+	if err := os.Symlink(secret, filepath.Join(dir, "999-evil.log")); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := m.readLogs("m1", u.Username)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || !strings.Contains(string(files[0].Data), "hello") {
+		t.Fatalf("logs = %+v", files)
+	}
+	info, err = os.Stat(filepath.Join(dir, files[0].Name))
+	if err != nil || info.Mode().Perm() != 0o600 {
+		t.Errorf("log file: %v, %v", info, err)
+	}
+	if other, err := user.Lookup("nobody"); err == nil && other.Uid != u.Uid {
+		if _, err := m.readLogs("m1", "nobody"); err == nil {
+			t.Error("logs of another user read")
+		}
+	}
+	if _, err := m.readLogs("../m1", ""); err == nil {
+		t.Error("invalid id read")
+	}
+}
@@ -1,370 +1,571 @@
 package migrator
 
 import (
+	"context"
 	"cr/apptainer"
+	"cr/transfer"
 	"cr/util"
-	"encoding/binary"
-	"io"
-	"io/ioutil"
+	"crypto/tls"
+	"errors"
 	"log"
-	"net"
-	"net/rpc"
-	"os"
-	"os/exec"
-	"path/filepath"
+	"sync"
+	"time"
+)
+
+// DefaultStreams is how many connections a transfer is spread over
+const DefaultStreams = 4
+
+const (
+	// SyncNative syncs checkpoint dirs over the transfer protocol
+	SyncNative = "native"
+	// SyncRsync syncs checkpoint dirs with rsync over SSH as the user
+	SyncRsync = "rsync"
 )
 
 type Migrator struct {
 	IsSharedFS bool
+	// Journal records the phases of every migration, nil disables it
+	Journal *Journal
+	// MaxOutbound and MaxInbound cap the migrations running from and to
+	// this node, further ones queue
+	MaxOutbound int
+	MaxInbound  int
+	// Runtime runs the containers, apptainer if nil
+	Runtime ContainerRuntime
+	// Timeouts bounds every step of a migration
+	Timeouts Timeouts
+	// TLS secures the connections with peers if not nil, the servers
+	// listen with it too
+	TLS *tls.Config
+	// Peers are where the servers accept peers from, nil for anywhere
+	Peers util.PeerFilter
+	// LogDir keeps the output of the commands of every migration in a
+	// directory named after it, empty turns it off
+	LogDir string
+	// Sync is how checkpoint dirs reach the target without a shared
+	// filesystem, SyncNative if empty
+	Sync string
+	// Codec compresses the files the migrator sends unless a migration
+	// asks for another, auto if empty
+	Codec transfer.Codec
+	// Streams is how many connections a transfer is spread over unless a
+	// migration asks for another number, DefaultStreams if zero
+	Streams int
+	// BwLimit caps the bytes per second the transfers from this node send
+	// together, split fairly among the running migrations, 0 for no cap
+	BwLimit int64
+	// MigrationBwLimit caps every migration on its own unless it asks for
+	// another cap, 0 for none
+	MigrationBwLimit int64
+
+	mu   sync.Mutex
+	jobs map[string]*Job
+	// locks maps the instances being migrated from this node to their jobs
+	locks map[string]string
+	// inboundHolders are the migrations holding an inbound slot, with the
+	// timer giving it back if the source abandons the migration between
+	// requests
+	inboundHolders map[string]*time.Timer
+	limitsOnce     sync.Once
+	outbound       chan struct{}
+	inbound        chan struct{}
+	bandwidth      *transfer.Limiter
+	// images maps the migrations syncing to this node to their sessions,
+	// imagesWait is closed when one of those changes
+	images     map[string]map[string]*imageSession
+	imagesWait chan struct{}
 }
 
-func (m *Migrator) Migrate(req *MigrateRequest, res *MigrateResponse) error {
+func (m *Migrator) migrate(mg *migration, req *MigrateRequest, res *MigrateResponse) error {
 	log.Printf("migrate request received: %v", req)
+	if err := mg.start(); err != nil {
+		log.Printf("%v", err)
+		mg.fail(ErrCanceled, StepQueue, err)
+		res.Status = CANCELED
+		return nil
+	}
 	// 1. dump the container
-	cmd := exec.Command(
-		"apptainer",
-		"checkpoint",
-		"instance",
-		"--criu",
-		req.InstanceName,
-	)
-
-	err := cmd.Run()
-	if err != nil {
-		log.Printf("failed to dump instance %s: %v", req.InstanceName, err)
+	mg.frozen()
+	start := time.Now()
+	ctx, cancel := mg.withTimeout(StepDump, false)
+	dumpErr := m.timedOut(ctx, StepDump, m.runtime().Checkpoint(ctx, req.UserName, req.InstanceName, CheckpointOptions{}))
+	cancel()
+	mg.report.Dump = time.Since(start)
+	if dumpErr != nil {
+		log.Printf("failed to dump instance %s: %v", req.InstanceName, dumpErr)
 	}
 
-	instance, err := apptainer.GetContainerStatus(req.UserName, req.InstanceName)
+	instance, err := m.runtime().Instance(req.UserName, req.InstanceName)
 	if err != nil {
 		log.Printf("failed to get checkpoint name of instance %s: %v", req.InstanceName, err)
 		res.Status = FAIL
-		return err
+		return mg.fail(ErrInstanceNotFound, StepLookup, err)
+	}
+	// a dump killed by its deadline left no usable checkpoint
+	if errors.Is(dumpErr, context.DeadlineExceeded) {
+		mg.fail(ErrDumpFailed, StepDump, dumpErr)
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
 	}
 
 	log.Printf("dump instance %s to checkpoint %s", req.InstanceName, instance.Checkpoint)
+	mg.setInstance(instance.Checkpoint, instance.Image)
+	mg.phase(PhaseDumped)
+	if mg.canceled() {
+		res.Status = m.rollback(mg, instance, nil, true)
+		return nil
+	}
 
-	// 2. stop the container
-	cmd = exec.Command(
-		"apptainer",
-		"instance",
-		"stop",
-		req.InstanceName,
-	)
-	// don't wait for the command to finish
-	go func() {
-		err = cmd.Run()
-		if err != nil {
-			log.Printf("failed to stop instance %s: %v", req.InstanceName, err)
-		}
-	}()
+	// 2. stop the container, don't wait for the command to finish. The
+	// checkpoint holds the whole container, so the source can restart from
+	// it if the target fails
+	stopped := mg.stopSource()
+	mg.phase(PhaseSourceStopped)
 
 	// 3. if not in shared filesystem, rsync the checkpoint to the target
-	if !m.IsSharedFS {
-		// 3.1 get the checkpoint dir
-		checkpointDir, err := apptainer.GetCheckpointDir(req.UserName, instance.Checkpoint)
-		if err != nil {
-			log.Printf("failed to get checkpoint dir of instance %s: %v", req.InstanceName, err)
-			res.Status = FAIL
-			return err
-		}
+	// 3.1 get the checkpoint dir
+	checkpointDir, err := apptainer.GetCheckpointDir(req.UserName, instance.Checkpoint)
+	if err != nil {
+		log.Printf("failed to get checkpoint dir of instance %s: %v", req.InstanceName, err)
+		mg.fail(ErrCheckpoint, StepLookup, err)
+		res.Status = m.rollback(mg, instance, stopped, true)
+		return nil
+	}
 
-		// 3.2 run rsync
-		err = util.DoRsync(req.UserName, checkpointDir, req.Target)
-		if err != nil {
-			log.Printf("failed to rsync checkpoint %s to %s: %v", instance.Checkpoint, req.Target, err)
-			res.Status = FAIL
-			return err
-		}
+	// 3.2 run rsync
+	err = m.syncCheckpoint(mg, checkpointDir, req.Target)
+	if err != nil {
+		log.Printf("failed to rsync checkpoint %s to %s: %v", instance.Checkpoint, req.Target, err)
+		mg.fail(ErrTransferFailed, StepTransfer, err)
+		res.Status = m.rollback(mg, instance, stopped, true)
+		return nil
+	}
+	mg.phase(PhaseTransferred)
+	if mg.canceled() {
+		res.Status = m.rollback(mg, instance, stopped, true)
+		return nil
 	}
 
 	// 4. request the server to restore the container
-	client, err := rpc.DialHTTP("tcp", req.Target+RPCPort)
+	ctx, cancel = mg.withTimeout(StepConnect, true)
+	client, err := m.dialPeer(ctx, req.Target)
+	cancel()
 	if err != nil {
 		log.Printf("failed to connect to server: %v", err)
-		res.Status = FAIL
-		return err
+		mg.fail(ErrUnreachable, StepConnect, err)
+		res.Status = m.rollback(mg, instance, stopped, true)
+		return nil
 	}
 	defer client.Close()
 
 	r := RestartContainerResponse{}
 
-	err = client.Call("Migrator.RestartContainer", &RestartContainerRequest{
+	start = time.Now()
+	ctx, cancel = m.callContext(StepRestore)
+	err = call(ctx, client, "Migrator.RestartContainer", &RestartContainerRequest{
+		MigrationID:    mg.entry.ID,
 		UserName:       req.UserName,
 		InstanceName:   req.InstanceName,
 		CheckpointName: instance.Checkpoint,
 		ImagePath:      instance.Image,
+		Synced:         m.syncsNatively(),
+		Images:         mg.images,
+		Timeout:        m.Timeouts.of(StepRestore),
 	}, &r)
+	cancel()
+	mg.report.Restore = time.Since(start)
 
 	if err != nil || r.Status != OK {
 		log.Printf("failed to restart container %s: %v", req.InstanceName, err)
-		res.Status = FAIL
-		return err
+		mg.failRemote(ErrRestoreFailed, StepRestore, err, r.Err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			// the target may still be restarting it
+			m.stopRemoteInstance(client, mg.entry.ID, req.UserName, req.InstanceName)
+		}
+		res.Status = m.rollback(mg, instance, stopped, true)
+		return nil
 	}
+	mg.resumed()
 	log.Printf("restart container %s successfully", req.InstanceName)
+	mg.phase(PhaseRestarted)
+	<-stopped
 	res.Status = OK
 	return nil
 }
 
-func (m *Migrator) DisklessMigrate(req *DisklessMigrateRequest, res *DisklessMigrateResponse) error {
+func (m *Migrator) disklessMigrate(mg *migration, req *DisklessMigrateRequest, res *DisklessMigrateResponse) error {
 	log.Printf("diskless migrate request: %v", req)
+	if err := mg.start(); err != nil {
+		log.Printf("%v", err)
+		mg.fail(ErrCanceled, StepQueue, err)
+		res.Status = CANCELED
+		return nil
+	}
 	// 1. check if the checkpoint is memory mode
-	instance, err := apptainer.GetContainerStatus(req.UserName, req.InstanceName)
+	instance, err := m.runtime().Instance(req.UserName, req.InstanceName)
 	if err != nil {
 		log.Printf("failed to get checkpoint name of instance %s: %v", req.InstanceName, err)
 		res.Status = FAIL
-		return err
+		return mg.fail(ErrInstanceNotFound, StepLookup, err)
 	}
 	checkpointDir, err := apptainer.GetCheckpointDir(req.UserName, instance.Checkpoint)
 	if err != nil {
 		log.Printf("failed to get checkpoint dir of instance %s: %v", req.InstanceName, err)
 		res.Status = FAIL
-		return err
+		return mg.fail(ErrCheckpoint, StepLookup, err)
 	}
 	imgDir, err := apptainer.GetImageRealPath(checkpointDir)
 	if err != nil {
 		log.Printf("failed to get real path of checkpoint %s: %v", instance.Checkpoint, err)
 		res.Status = FAIL
-		return err
+		return mg.fail(ErrCheckpoint, StepLookup, err)
 	}
 
 	log.Printf("image is stored at %v", imgDir)
+	mg.setInstance(instance.Checkpoint, instance.Image)
 
 	// 2. if not in shared filesystem, rsync the checkpointDir to the target
-	if !m.IsSharedFS {
-		err = util.DoRsync(req.UserName, checkpointDir, req.Target)
-		if err != nil {
-			log.Printf("failed to rsync checkpoint %s to %s: %v", instance.Checkpoint, req.Target, err)
-			res.Status = FAIL
-			return err
-		}
+	err = m.syncCheckpoint(mg, checkpointDir, req.Target)
+	if err != nil {
+		log.Printf("failed to rsync checkpoint %s to %s: %v", instance.Checkpoint, req.Target, err)
+		mg.fail(ErrTransferFailed, StepTransfer, err)
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
+	}
+	if mg.canceled() {
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
 	}
 
 	// 3. request the dest node to launch a page server
-	client, err := rpc.DialHTTP("tcp", req.Target+RPCPort)
+	ctx, cancel := mg.withTimeout(StepConnect, true)
+	client, err := m.dialPeer(ctx, req.Target)
+	cancel()
 	if err != nil {
 		log.Printf("failed to connect to server %v:%v: %v", req.Target, RPCPort, err)
-		res.Status = FAIL
-		return err
+		mg.fail(ErrUnreachable, StepConnect, err)
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
 	}
+	defer client.Close()
 	pageServerRes := LaunchPageServerResponse{}
-	err = client.Call("Migrator.LaunchPageServer", &LaunchPageServerRequest{
+	start := time.Now()
+	ctx, cancel = m.callContext(StepPageServer)
+	err = call(ctx, client, "Migrator.LaunchPageServer", &LaunchPageServerRequest{
+		MigrationID:    mg.entry.ID,
 		UserName:       req.UserName,
 		InstanceName:   req.InstanceName,
 		CheckpointName: instance.Checkpoint,
 		ImagePath:      instance.Image,
+		Timeout:        m.Timeouts.of(StepPageServer),
 	}, &pageServerRes)
+	cancel()
+	mg.report.PageServer = time.Since(start)
 	if err != nil || pageServerRes.Status != OK {
 		log.Printf("failed to launch page server: %v", err)
-		res.Status = FAIL
-		return err
+		mg.failRemote(ErrPageServerFailed, StepPageServer, err, pageServerRes.Err)
+		m.stopRemoteInstance(client, mg.entry.ID, req.UserName, req.InstanceName)
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
 	}
 	log.Printf("page server launched successfully")
+	mg.phase(PhasePageServerLaunched)
+
+	// the pages now live on the target only, so the source container keeps
+	// running until the target has restored it and is the only way back
+	fail := func() error {
+		m.stopRemoteInstance(client, mg.entry.ID, req.UserName, req.InstanceName)
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
+	}
+	if mg.canceled() {
+		return fail()
+	}
 
 	// 4. dump the container, criu will send pages to the page server,
 	// and store other files in the tmpfs
-	cmd := exec.Command(
-		"apptainer",
-		"checkpoint",
-		"instance",
-		"--criu",
-		"--page-server",
-		"--address",
-		req.Target,
-		req.InstanceName,
-	)
-	err = cmd.Run()
+	mg.frozen()
+	start = time.Now()
+	ctx, cancel = mg.withTimeout(StepDump, false)
+	err = m.timedOut(ctx, StepDump, m.runtime().Checkpoint(ctx, req.UserName, req.InstanceName, CheckpointOptions{
+		PageServer: true,
+		Address:    req.Target,
+	}))
+	cancel()
+	mg.report.Dump = time.Since(start)
 	if err != nil {
 		log.Printf("failed to dump instance %s: %v", req.InstanceName, err)
 	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		mg.fail(ErrDumpFailed, StepDump, err)
+		return fail()
+	}
 	log.Printf("dump container successfully")
+	mg.phase(PhaseDumped)
+	if mg.canceled() {
+		return fail()
+	}
 
 	// 5. if not in sharedFS, rsync some log files to the server
-	if !m.IsSharedFS {
-		err = util.DoRsync(req.UserName, checkpointDir, req.Target)
-		if err != nil {
-			log.Printf("failed to rsync checkpoint %s to %s: %v", instance.Checkpoint, req.Target, err)
-			res.Status = FAIL
-			return err
-		}
+	err = m.syncCheckpoint(mg, checkpointDir, req.Target)
+	if err != nil {
+		log.Printf("failed to rsync checkpoint %s to %s: %v", instance.Checkpoint, req.Target, err)
+		mg.fail(ErrTransferFailed, StepTransfer, err)
+		return fail()
 	}
 
-	// 6. stop the container
-	cmd = exec.Command(
-		"apptainer",
-		"instance",
-		"stop",
-		req.InstanceName,
-	)
-
-	go func() {
-		err = cmd.Run()
-		if err != nil {
-			log.Printf("failed to stop instance %s: %v", req.InstanceName, err)
-		}
-	}()
-
-	// 7. send other files to the server
-	err = sendImages(req.Target+FilePort, imgDir, req.UserName)
+	// 6. send other files to the server
+	start = time.Now()
+	ctx, cancel = mg.withTimeout(StepImageSend, true)
+	// the images go straight from tmpfs into the connections, the target
+	// confirms they're all there
+	stats, err := mg.syncDir(ctx, req.Target+FilePort, imgDir)
+	err = m.timedOut(ctx, StepImageSend, err)
+	cancel()
+	mg.report.ImageSend = time.Since(start)
+	mg.sent(stats)
 	if err != nil {
 		log.Printf("failed to send images to server: %v", err)
-		res.Status = FAIL
-		return err
+		mg.fail(ErrTransferFailed, StepImageSend, err)
+		return fail()
 	}
 	log.Printf("send images successfully")
+	mg.phase(PhaseTransferred)
+	if mg.canceled() {
+		return fail()
+	}
 
-	// 8. request the server to restore
+	// 7. request the server to restore
 	restoreRes := RestoreResponse{}
-	err = client.Call("Migrator.Restore", &RestoreRequest{
-		UserName:     req.UserName,
-		InstanceName: req.InstanceName,
+	start = time.Now()
+	ctx, cancel = m.callContext(StepRestore)
+	err = call(ctx, client, "Migrator.Restore", &RestoreRequest{
+		MigrationID:    mg.entry.ID,
+		UserName:       req.UserName,
+		InstanceName:   req.InstanceName,
+		CheckpointName: instance.Checkpoint,
+		ImagePath:      instance.Image,
+		Images:         mg.images,
+		Timeout:        m.Timeouts.of(StepRestore),
 	}, &restoreRes)
+	cancel()
+	mg.report.Restore = time.Since(start)
 	if err != nil || restoreRes.Status != OK {
 		log.Printf("failed to restore container %s: %v", req.InstanceName, err)
-		res.Status = FAIL
-		return err
+		mg.failRemote(ErrRestoreFailed, StepRestore, err, restoreRes.Err)
+		return fail()
 	}
+	mg.resumed()
 	log.Printf("restore container successfully")
+	mg.phase(PhaseRestarted)
+
+	// 8. the target took over, stop the container
+	<-mg.stopSource()
+	mg.phase(PhaseSourceStopped)
 	res.Status = OK
 	return nil
 }
 
 func (m *Migrator) RestartContainer(req *RestartContainerRequest, res *RestartContainerResponse) error {
-	cmd := exec.Command(
-		"apptainer",
-		"instance",
-		"start",
-		"--criu-restart",
-		req.CheckpointName,
-		req.ImagePath,
-		req.InstanceName,
-	)
-	err := cmd.Run()
+	if err := validMigrationID(req.MigrationID); err != nil {
+		res.Status = FAIL
+		res.Err = newError(ErrInvalidRequest, StepRestore, err)
+		return nil
+	}
+	mg := m.newMigration(req.MigrationID, RoleTarget, ModeMigrate, req.UserName, req.InstanceName, "")
+	mg.setInstance(req.CheckpointName, req.ImagePath)
+	mg.phase(PhaseStarted)
+	defer func() { mg.finish(res.Status, nil) }()
+	ctx, cancel := mg.peerContext(StepRestore, req.Timeout)
+	defer cancel()
+	err := m.acquireInbound(ctx, mg.entry.ID)
+	if err != nil {
+		log.Printf("refuse to restore instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		res.Err = mg.fail(ErrBusy, StepRestore, err)
+		return nil
+	}
+	// the images the source synced must all be there
+	err = m.waitImages(ctx, req.MigrationID, req.UserName, req.Synced, req.Images)
+	if err != nil {
+		log.Printf("refuse to restore instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		res.Err = mg.fail(ErrImagesIncomplete, StepRestore, err)
+		return nil
+	}
+	err = m.runtime().Restart(ctx, req.UserName, req.InstanceName, req.CheckpointName, req.ImagePath, RestartOptions{})
+	err = m.timedOut(ctx, StepRestore, err)
 	if err != nil {
 		log.Printf("failed to restart instance %s: %v", req.InstanceName, err)
 		res.Status = FAIL
-		return err
+		res.Err = mg.fail(ErrRestoreFailed, StepRestore, err)
+		return nil
 	}
 	res.Status = OK
 	return nil
 }
 
 func (m *Migrator) LaunchPageServer(req *LaunchPageServerRequest, res *LaunchPageServerResponse) error {
+	if err := validMigrationID(req.MigrationID); err != nil {
+		res.Status = FAIL
+		res.Err = newError(ErrInvalidRequest, StepPageServer, err)
+		return nil
+	}
+	mg := m.newMigration(req.MigrationID, RoleTarget, ModeDiskless, req.UserName, req.InstanceName, "")
+	mg.setInstance(req.CheckpointName, req.ImagePath)
+	mg.phase(PhaseStarted)
+	ctx, cancel := mg.peerContext(StepPageServer, req.Timeout)
+	defer cancel()
+	err := m.acquireInbound(ctx, mg.entry.ID)
+	if err != nil {
+		log.Printf("refuse to launch page server: %v", err)
+		res.Status = FAIL
+		res.Err = mg.fail(ErrBusy, StepPageServer, err)
+		mg.finish(res.Status, err)
+		return nil
+	}
 	// 1. config checkpoint as memory mode
-	cmd := exec.Command(
-		"apptainer",
-		"checkpoint",
-		"config",
-		req.CheckpointName,
-		"memory",
-	)
-	err := cmd.Run()
+	err = m.timedOut(ctx, StepPageServer, m.runtime().ConfigureCheckpoint(ctx, req.UserName, req.CheckpointName, "memory"))
 	if err != nil {
 		log.Printf("failed to config checkpoint as memory mode: %v", err)
 		res.Status = FAIL
-		return err
+		res.Err = mg.fail(ErrCheckpoint, StepPageServer, err)
+		mg.finish(res.Status, err)
+		return nil
 	}
 	log.Printf("checkpoint configured as memory mode successfully")
 
 	// 2. launch page server
-	cmd = exec.Command(
-		"apptainer",
-		"instance",
-		"start",
-		"--criu-restart",
-		req.CheckpointName,
-		"--page-server",
-		req.ImagePath,
-		req.InstanceName,
-	)
-	err = cmd.Run()
+	err = m.timedOut(ctx, StepPageServer, m.runtime().LaunchPageServer(ctx, req.UserName, req.InstanceName, req.CheckpointName, req.ImagePath))
 	if err != nil {
 		log.Printf("failed to launch page server: %v", err)
 		res.Status = FAIL
-		return err
+		res.Err = mg.fail(ErrPageServerFailed, StepPageServer, err)
+		mg.finish(res.Status, err)
+		return nil
 	}
 	log.Printf("page server launched successfully")
+	// the migration goes on with Restore, which the source sends once it
+	// dumped and synced the container
+	mg.phase(PhasePageServerLaunched)
+	m.keepInbound(mg.entry.ID, m.Timeouts.of(StepDump)+m.Timeouts.of(StepTransfer)+m.Timeouts.of(StepImageSend)+m.Timeouts.of(StepRestore))
 	res.Status = OK
 	return nil
 }
 
-func (m *Migrator) AsyncImgs() error {
-	return nil
+// streams returns how many connections a transfer is spread over by
+// default
+func (m *Migrator) streams() int {
+	if m.Streams <= 0 {
+		return DefaultStreams
+	}
+	return m.Streams
 }
 
-func (m *Migrator) Restore(req *RestoreRequest, res *RestoreResponse) error {
-	cmd := exec.Command(
-		"apptainer",
-		"checkpoint",
-		"instance",
-		"--criu",
-		"--restore",
-		req.InstanceName,
-	)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Start()
-
-	if err != nil {
-		res.Status = FAIL
-		log.Printf("failed to restore instance %s: %v", req.InstanceName, err)
-		return err
+// codec returns the codec migrations compress with by default
+func (m *Migrator) codec() transfer.Codec {
+	if m.Codec.Name == "" {
+		return transfer.Codec{Name: transfer.CodecAuto}
 	}
-	log.Printf("restore container successfully")
-	res.Status = OK
-	return nil
+	return m.Codec
 }
 
-// TODO: maybe we can simplify transfering images by using rsync
-func sendImages(addr string, imgDir string, userName string) error {
-	// 1. connect to the server
-	client, err := net.Dial("tcp", addr)
-	if err != nil {
-		log.Printf("failed to connect to server %v: %v", addr, err)
-		return err
+// syncsNatively tells whether checkpoint dirs reach the target over the
+// transfer protocol, which confirms them complete
+func (m *Migrator) syncsNatively() bool {
+	return !m.IsSharedFS && m.Sync != SyncRsync
+}
+
+// syncCheckpoint ships the checkpoint dir to the target while the container
+// keeps running and accounts for it in the report. On a shared filesystem
+// the target already sees it, so there is nothing to do.
+func (m *Migrator) syncCheckpoint(mg *migration, checkpointDir, target string) error {
+	if m.IsSharedFS {
+		return nil
 	}
-	defer client.Close()
-	// 2. tar the images
-	tarballPath := filepath.Join(imgDir, "img.tar.gz")
-	var imageFiles []string
-	// get all file names under imgDir
-	files, err := ioutil.ReadDir(imgDir)
-	if err != nil {
-		log.Printf("read all files failes, %v", err)
-		return err
+	start := time.Now()
+	ctx, cancel := mg.withTimeout(StepTransfer, true)
+	defer cancel()
+	var stats transfer.Stats
+	var err error
+	if m.Sync == SyncRsync {
+		share := m.share(mg.bwlimit)
+		// rsync keeps the rate it starts with
+		var n int64
+		n, err = util.DoRsync(ctx, mg.entry.UserName, checkpointDir, target, share.Rate())
+		share.Release()
+		stats = transfer.Stats{Codec: transfer.Codec{Name: transfer.CodecNone}, Raw: n, Wire: n}
+	} else {
+		stats, err = mg.syncDir(ctx, target+FilePort, checkpointDir)
 	}
-	for _, f := range files {
-		imageFiles = append(imageFiles, f.Name())
+	mg.report.Transfer += time.Since(start)
+	mg.sent(stats)
+	return m.timedOut(ctx, StepTransfer, err)
+}
+
+func (m *Migrator) Restore(req *RestoreRequest, res *RestoreResponse) error {
+	if err := validMigrationID(req.MigrationID); err != nil {
+		res.Status = FAIL
+		res.Err = newError(ErrInvalidRequest, StepRestore, err)
+		return nil
 	}
-	tarCmd := exec.Command("tar", append([]string{"-zcf", "img.tar.gz"}, imageFiles...)...)
-	tarCmd.Dir = imgDir
-	err = tarCmd.Run()
+	mg := m.newMigration(req.MigrationID, RoleTarget, ModeDiskless, req.UserName, req.InstanceName, "")
+	mg.setInstance(req.CheckpointName, req.ImagePath)
+	defer func() { mg.finish(res.Status, nil) }()
+	ctx, cancel := mg.peerContext(StepRestore, req.Timeout)
+	defer cancel()
+	// the slot is left from LaunchPageServer unless it expired meanwhile
+	err := m.acquireInbound(ctx, mg.entry.ID)
 	if err != nil {
-		return err
+		log.Printf("refuse to restore instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		res.Err = mg.fail(ErrBusy, StepRestore, err)
+		return nil
 	}
-	log.Printf("tar images at %v successfully", imgDir)
-
-	// 3. send tarball to server
-	// 3.1. send 4 bytes as integer as the length of the tarball path
-	fileNameLength := int32(len(tarballPath))
-	err = binary.Write(client, binary.LittleEndian, &fileNameLength)
+	// the images the source synced must all be there
+	err = m.waitImages(ctx, req.MigrationID, req.UserName, true, req.Images)
 	if err != nil {
-		log.Printf("failed to read file name length: %v", err)
-		return err
+		log.Printf("refuse to restore instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		res.Err = mg.fail(ErrImagesIncomplete, StepRestore, err)
+		return nil
 	}
-	// 3.2. send the tarball path
-	// TODO: encode the file name
-	io.WriteString(client, tarballPath)
+	err = m.timedOut(ctx, StepRestore, m.runtime().Restore(ctx, req.UserName, req.InstanceName))
 	if err != nil {
-		log.Printf("failed to read file name: %v", err)
-		return err
+		res.Status = FAIL
+		log.Printf("failed to restore instance %s: %v", req.InstanceName, err)
+		res.Err = mg.fail(ErrRestoreFailed, StepRestore, err)
+		return nil
 	}
+	log.Printf("restore container successfully")
+	mg.phase(PhaseRestarted)
+	res.Status = OK
+	return nil
+}
 
-	// 3.3. send tarball
-	err = util.SendFile(client, tarballPath)
-	log.Printf("send tarball %s successfully", tarballPath)
+// syncDir brings dir on the file server at addr up to date in a session of
+// the migration, over its streams, with its codec and within its share of
+// the bandwidth, and returns what was sent. The target confirms the dir
+// complete before syncDir returns, the restore on the target waits for that.
+func (mg *migration) syncDir(ctx context.Context, addr, dir string) (transfer.Stats, error) {
+	share := mg.m.share(mg.bwlimit)
+	defer share.Release()
+	// a cancel interrupts the transfer
+	pool, err := transfer.DialPool(ctx, addr, mg.entry.UserName, mg.entry.ID, mg.m.TLS, mg.codec, mg.streams)
 	if err != nil {
-		log.Printf("failed to receive file: %v", err)
-		return err
+		log.Printf("failed to connect to server %v: %v", addr, err)
+		return transfer.Stats{}, err
 	}
-	return nil
+	defer pool.Close()
+	pool.Limit(share)
+	log.Printf("sync %s to %s over %d streams at %s/s", dir, addr, mg.streams, transfer.FormatRate(share.Rate()))
+	_, err = pool.SyncDir(dir, dir, mg.progress)
+	stats := pool.Stats()
+	if err != nil {
+		log.Printf("failed to sync %s: %v", dir, err)
+		return stats, err
+	}
+	log.Printf("synced %s with %v, %d bytes sent for %d", dir, stats.Codec, stats.Wire, stats.Raw)
+	mg.synced(dir)
+	return stats, nil
 }
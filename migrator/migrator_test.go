@@ -0,0 +1,155 @@
+package migrator
+
+import (
+	"cr/apptainer"
+	"cr/transfer"
+	"errors"
+	"net"
+	"net/http"
+	"net/rpc"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveTarget serves the peer service of a migrator running rt on
+// 127.0.0.2, the migrators dial peers on RPCPort
+func serveTarget(t *testing.T, rt *FakeRuntime) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.2"+RPCPort)
+	if err != nil {
+		t.Skipf("can't listen for the target: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	server := rpc.NewServer()
+	if err := server.RegisterName("Migrator", (&Migrator{IsSharedFS: true, Runtime: rt}).Peer()); err != nil {
+		t.Fatal(err)
+	}
+	go http.Serve(l, server)
+}
+
+// runJob runs the migration req asks for as a job and returns the job once
+// it's done
+func runJob(t *testing.T, m *Migrator, req StartMigrationRequest) Job {
+	t.Helper()
+	res := StartMigrationResponse{}
+	if err := m.StartMigration(&req, &res); err != nil {
+		t.Fatal(err)
+	}
+	status := JobStatusResponse{}
+	if err := m.WaitJob(&WaitJobRequest{JobID: res.JobID, Timeout: 10 * time.Second}, &status); err != nil {
+		t.Fatal(err)
+	}
+	if !status.Job.Done {
+		t.Fatalf("job %s still in phase %s", res.JobID, status.Job.Phase)
+	}
+	return status.Job
+}
+
+// hasCalls tells whether calls holds a call to each method, in order
+func hasCalls(calls []string, methods ...string) bool {
+	for _, c := range calls {
+		if len(methods) > 0 && strings.HasPrefix(c, methods[0]+" ") {
+			methods = methods[1:]
+		}
+	}
+	return len(methods) == 0
+}
+
+func TestMigrate(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		targetErr error
+		want      Status
+		source    []string
+		target    []string
+	}{
+		{"restarted", nil, OK, []string{"Checkpoint", "Stop"}, []string{"Restart"}},
+		{"rolled back", errors.New("restore failed"), ROLLEDBACK, []string{"Checkpoint", "Stop", "Restart"}, []string{"Restart"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tgt := NewFakeRuntime()
+			if tt.targetErr != nil {
+				tgt.Errors["Restart"] = tt.targetErr
+			}
+			serveTarget(t, tgt)
+			src := NewFakeRuntime()
+			src.AddInstance(u.Username, apptainer.File{Name: "app", Image: "/images/app.sif", Checkpoint: "app-ckpt"})
+			m := &Migrator{IsSharedFS: true, Runtime: src}
+
+			job := runJob(t, m, StartMigrationRequest{UserName: u.Username, InstanceName: "app", Target: "127.0.0.2"})
+			if job.Result != tt.want {
+				t.Fatalf("status = %v, want %v: %v", job.Result, tt.want, job.Err)
+			}
+			if tt.want != OK && job.Err == nil {
+				t.Error("no error reported")
+			}
+			if calls := src.Calls(); !hasCalls(calls, tt.source...) {
+				t.Errorf("source calls = %q, want %q", calls, tt.source)
+			}
+			if calls := tgt.Calls(); !hasCalls(calls, tt.target...) {
+				t.Errorf("target calls = %q, want %q", calls, tt.target)
+			}
+			_, err := tgt.Instance(u.Username, "app")
+			if running := err == nil; running != (tt.want == OK) {
+				t.Errorf("instance running on the target = %v", running)
+			}
+		})
+	}
+}
+
+func TestRestartContainer(t *testing.T) {
+	tests := []struct {
+		name string
+		req  RestartContainerRequest
+		want ErrorCode
+	}{
+		{"bad id", RestartContainerRequest{MigrationID: "../x", UserName: "u", InstanceName: "app"}, ErrInvalidRequest},
+		{"no images", RestartContainerRequest{MigrationID: "m1", UserName: "u", InstanceName: "app", Synced: true}, ErrImagesIncomplete},
+		{"images never synced", RestartContainerRequest{MigrationID: "m2", UserName: "u", InstanceName: "app", Synced: true, Images: []string{"/ckpt"}}, ErrImagesIncomplete},
+	}
+	for _, tt := range tests {
+		rt := NewFakeRuntime()
+		m := &Migrator{Runtime: rt}
+		res := RestartContainerResponse{}
+		if err := m.RestartContainer(&tt.req, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != FAIL || res.Err == nil || res.Err.Code != tt.want {
+			t.Errorf("%s: status %v, error %v, want %s", tt.name, res.Status, res.Err, tt.want)
+		}
+		if calls := rt.Calls(); len(calls) > 0 {
+			t.Errorf("%s: runtime called %q", tt.name, calls)
+		}
+	}
+}
+
+func TestTargetCheckVersions(t *testing.T) {
+	tests := []struct {
+		name              string
+		version, transfer int
+		want              string
+	}{
+		{"old protocol", ProtocolVersion - 1, transfer.Version, "protocol version"},
+		{"old transfer", ProtocolVersion, transfer.Version - 1, "transfer version"},
+	}
+	for _, tt := range tests {
+		m := &Migrator{Runtime: NewFakeRuntime()}
+		res := TargetCheckResponse{}
+		if err := m.TargetCheck(&TargetCheckRequest{Version: tt.version, TransferVersion: tt.transfer}, &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Status != FAIL || len(res.Problems) != 1 || !strings.Contains(res.Problems[0], tt.want) {
+			t.Errorf("%s: status %v, problems %q", tt.name, res.Status, res.Problems)
+		}
+		if res.Version != ProtocolVersion || res.TransferVersion != transfer.Version {
+			t.Errorf("%s: target reports versions %d and %d", tt.name, res.Version, res.TransferVersion)
+		}
+	}
+}
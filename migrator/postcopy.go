@@ -0,0 +1,224 @@
+package migrator
+
+import (
+	"context"
+	"cr/apptainer"
+	"cr/util"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// waitLazyDump waits until criu has written the minimal dump into imgDir,
+// i.e. inventory.img is newer than since, until the dump exits early or ctx
+// is done.
+func waitLazyDump(ctx context.Context, imgDir string, since time.Time, dumpDone <-chan error) error {
+	inventory := filepath.Join(imgDir, "inventory.img")
+	// the filesystem stamps files with a coarser clock, a dump of an earlier
+	// migration is far older anyway
+	since = since.Add(-time.Second)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-dumpDone:
+			if err == nil {
+				err = fmt.Errorf("lazy dump exited before serving pages")
+			}
+			return err
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for lazy dump at %s: %w", imgDir, ctx.Err())
+		case <-ticker.C:
+			info, err := os.Stat(inventory)
+			if err == nil && !info.ModTime().Before(since) {
+				return nil
+			}
+		}
+	}
+}
+
+func (m *Migrator) postcopyMigrate(mg *migration, req *PostcopyMigrateRequest, res *PostcopyMigrateResponse) error {
+	log.Printf("post-copy migrate request received: %v", req)
+	if err := mg.start(); err != nil {
+		log.Printf("%v", err)
+		mg.fail(ErrCanceled, StepQueue, err)
+		res.Status = CANCELED
+		return nil
+	}
+	instance, err := m.runtime().Instance(req.UserName, req.InstanceName)
+	if err != nil {
+		log.Printf("failed to get checkpoint name of instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		return mg.fail(ErrInstanceNotFound, StepLookup, err)
+	}
+	checkpointDir, err := apptainer.GetCheckpointDir(req.UserName, instance.Checkpoint)
+	if err != nil {
+		log.Printf("failed to get checkpoint dir of instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		return mg.fail(ErrCheckpoint, StepLookup, err)
+	}
+	mg.setInstance(instance.Checkpoint, instance.Image)
+	source, err := util.LocalIP(req.Target)
+	if err != nil {
+		log.Printf("failed to get local address towards %s: %v", req.Target, err)
+		res.Status = FAIL
+		return mg.fail(ErrUnreachable, StepConnect, err)
+	}
+
+	// 1. dump the container without its memory pages, criu keeps running as
+	// a lazy-pages server until every page has been handed to the target
+	mg.frozen()
+	start := time.Now()
+	dumpCtx, killDump := context.WithCancel(mg.base)
+	defer killDump()
+	dumpDone := make(chan error, 1)
+	go func() {
+		dumpDone <- m.runtime().Checkpoint(dumpCtx, req.UserName, req.InstanceName, CheckpointOptions{
+			LazyPages: true,
+			Address:   source,
+		})
+	}()
+	ctx, cancel := mg.withTimeout(StepDump, false)
+	err = waitLazyDump(ctx, filepath.Join(checkpointDir, "img"), start, dumpDone)
+	cancel()
+	mg.report.Dump = time.Since(start)
+	if err != nil {
+		log.Printf("failed to dump instance %s: %v", req.InstanceName, err)
+		killDump()
+		res.Status = FAIL
+		return mg.fail(ErrDumpFailed, StepDump, err)
+	}
+	log.Printf("lazy-pages server of instance %s listens on %s", req.InstanceName, source)
+	mg.phase(PhaseDumped)
+
+	// 2. ship the minimal dump to the target
+	err = m.syncCheckpoint(mg, checkpointDir, req.Target)
+	if err != nil {
+		log.Printf("failed to ship checkpoint %s to %s: %v", instance.Checkpoint, req.Target, err)
+		mg.fail(ErrTransferFailed, StepTransfer, err)
+		killDump()
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
+	}
+	// last safe point, once the target restores the instance there is no
+	// way back
+	if mg.canceled() {
+		killDump()
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
+	}
+
+	// 3. request the target to restore the container, its pages are faulted
+	// in from the lazy-pages server on demand
+	ctx, cancel = mg.withTimeout(StepConnect, true)
+	client, err := m.dialPeer(ctx, req.Target)
+	cancel()
+	if err != nil {
+		log.Printf("failed to connect to server: %v", err)
+		mg.fail(ErrUnreachable, StepConnect, err)
+		killDump()
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
+	}
+	defer client.Close()
+
+	r := LazyRestoreResponse{}
+	restoreStart := time.Now()
+	ctx, cancel = m.callContext(StepRestore)
+	err = call(ctx, client, "Migrator.LazyRestore", &LazyRestoreRequest{
+		MigrationID:    mg.entry.ID,
+		UserName:       req.UserName,
+		InstanceName:   req.InstanceName,
+		CheckpointName: instance.Checkpoint,
+		ImagePath:      instance.Image,
+		Synced:         m.syncsNatively(),
+		Images:         mg.images,
+		Source:         source,
+		Timeout:        m.Timeouts.of(StepRestore),
+	}, &r)
+	cancel()
+	mg.report.Restore = time.Since(restoreStart)
+	if err != nil || r.Status != OK {
+		log.Printf("failed to lazy restore container %s: %v", req.InstanceName, err)
+		mg.failRemote(ErrRestoreFailed, StepRestore, err, r.Err)
+		killDump()
+		m.stopRemoteInstance(client, mg.entry.ID, req.UserName, req.InstanceName)
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
+	}
+	mg.resumed()
+	log.Printf("container %s runs on %s after %v", req.InstanceName, req.Target, time.Since(start))
+	mg.phase(PhaseRestarted)
+
+	// 4. wait for the background push of the remaining pages, the source can
+	// only be released after criu has handed out every page
+	pushStart := time.Now()
+	ctx, cancel = mg.withTimeout(StepTransfer, false)
+	select {
+	case err = <-dumpDone:
+	case <-ctx.Done():
+		killDump()
+		err = m.timedOut(ctx, StepTransfer, <-dumpDone)
+	}
+	cancel()
+	mg.report.Transfer += time.Since(pushStart)
+	if err != nil {
+		log.Printf("failed to push remaining pages of instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		return mg.fail(ErrTransferFailed, StepTransfer, err)
+	}
+	log.Printf("all pages of instance %s pushed to %s", req.InstanceName, req.Target)
+	mg.phase(PhaseTransferred)
+
+	// 5. stop the container
+	<-mg.stopSource()
+	mg.phase(PhaseSourceStopped)
+	res.Status = OK
+	return nil
+}
+
+func (m *Migrator) LazyRestore(req *LazyRestoreRequest, res *LazyRestoreResponse) error {
+	if err := validMigrationID(req.MigrationID); err != nil {
+		res.Status = FAIL
+		res.Err = newError(ErrInvalidRequest, StepRestore, err)
+		return nil
+	}
+	mg := m.newMigration(req.MigrationID, RoleTarget, ModePostcopy, req.UserName, req.InstanceName, "")
+	mg.setInstance(req.CheckpointName, req.ImagePath)
+	mg.phase(PhaseStarted)
+	defer func() { mg.finish(res.Status, nil) }()
+	ctx, cancel := mg.peerContext(StepRestore, req.Timeout)
+	defer cancel()
+	err := m.acquireInbound(ctx, mg.entry.ID)
+	if err != nil {
+		log.Printf("refuse to restore instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		res.Err = mg.fail(ErrBusy, StepRestore, err)
+		return nil
+	}
+	// the images the source synced must all be there
+	err = m.waitImages(ctx, req.MigrationID, req.UserName, req.Synced, req.Images)
+	if err != nil {
+		log.Printf("refuse to restore instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		res.Err = mg.fail(ErrImagesIncomplete, StepRestore, err)
+		return nil
+	}
+	err = m.runtime().Restart(ctx, req.UserName, req.InstanceName, req.CheckpointName, req.ImagePath, RestartOptions{
+		LazyPages: true,
+		Address:   req.Source,
+	})
+	err = m.timedOut(ctx, StepRestore, err)
+	if err != nil {
+		log.Printf("failed to lazy restore instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		res.Err = mg.fail(ErrRestoreFailed, StepRestore, err)
+		return nil
+	}
+	log.Printf("lazy restore instance %s from %s successfully", req.InstanceName, req.Source)
+	mg.phase(PhaseRestarted)
+	res.Status = OK
+	return nil
+}
@@ -0,0 +1,78 @@
+package migrator
+
+import (
+	"cr/apptainer"
+	"cr/util"
+	"errors"
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPostcopyMigrate(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		// restartErr fails the restore on the target
+		restartErr error
+		// served is whether the source hands out every page
+		served bool
+		want   Status
+		code   ErrorCode
+	}{
+		{"pages pushed", nil, true, OK, ""},
+		{"restore failed", errors.New("restore failed"), false, ROLLEDBACK, ErrRestoreFailed},
+		{"push timed out", nil, false, FAIL, ErrTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tgt := NewFakeRuntime()
+			if tt.restartErr != nil {
+				tgt.Errors["Restart"] = tt.restartErr
+			}
+			serveTarget(t, tgt)
+			src := NewFakeRuntime()
+			src.PagesServed = make(chan struct{})
+			checkpoint := "postcopy-test-" + util.NewID()
+			src.AddInstance(u.Username, apptainer.File{Name: "app", Image: "/images/app.sif", Checkpoint: checkpoint})
+			checkpointDir, err := apptainer.GetCheckpointDir(u.Username, checkpoint)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() { os.RemoveAll(checkpointDir) })
+			if tt.served {
+				// the pages are all handed out once the target restored
+				go func() {
+					for !hasCalls(tgt.Calls(), "Restart") {
+						time.Sleep(10 * time.Millisecond)
+					}
+					close(src.PagesServed)
+				}()
+			}
+			m := &Migrator{IsSharedFS: true, Runtime: src, Timeouts: Timeouts{Transfer: 300 * time.Millisecond}}
+
+			job := runJob(t, m, StartMigrationRequest{Mode: ModePostcopy, UserName: u.Username, InstanceName: "app", Target: "127.0.0.2"})
+			if job.Result != tt.want {
+				t.Fatalf("status = %v, want %v: %v", job.Result, tt.want, job.Err)
+			}
+			if tt.code != "" && (job.Err == nil || job.Err.Code != tt.code) {
+				t.Errorf("error = %v, want %s", job.Err, tt.code)
+			}
+			calls := src.Calls()
+			if !strings.Contains(calls[0], "Checkpoint app {false   false true") {
+				t.Errorf("first call %q isn't a lazy checkpoint", calls[0])
+			}
+			if stopped := hasCalls(calls, "Stop"); stopped != (tt.want == OK) {
+				t.Errorf("source stopped = %v: %q", stopped, calls)
+			}
+			if !hasCalls(tgt.Calls(), "Restart") {
+				t.Errorf("target calls = %q", tgt.Calls())
+			}
+		})
+	}
+}
@@ -0,0 +1,291 @@
+package migrator
+
+import (
+	"context"
+	"cr/apptainer"
+	"cr/util"
+	"errors"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DefaultMaxRounds      = 5
+	DefaultDirtyThreshold = 64 << 20
+	DefaultTimeBudget     = 5 * time.Minute
+)
+
+// PrecopyPolicy decides when the iterative pre-dump rounds stop and the
+// container is frozen for the final dump.
+type PrecopyPolicy struct {
+	// MaxRounds is the maximum number of pre-dump rounds
+	MaxRounds int
+	// DirtyThreshold is the dirty set size in bytes under which the
+	// pre-dump is considered converged
+	DirtyThreshold int64
+	// TimeBudget bounds the total time spent in pre-dump rounds
+	TimeBudget time.Duration
+}
+
+func newPrecopyPolicy(req *PrecopyMigrateRequest) PrecopyPolicy {
+	p := PrecopyPolicy{
+		MaxRounds:      req.MaxRounds,
+		DirtyThreshold: req.DirtyThreshold,
+		TimeBudget:     req.TimeBudget,
+	}
+	if p.MaxRounds <= 0 {
+		p.MaxRounds = DefaultMaxRounds
+	}
+	if p.DirtyThreshold <= 0 {
+		p.DirtyThreshold = DefaultDirtyThreshold
+	}
+	if p.TimeBudget <= 0 {
+		p.TimeBudget = DefaultTimeBudget
+	}
+	return p
+}
+
+// converged reports whether the final dump should be taken after a round
+// which left dirty bytes behind, given the dirty bytes of the round before.
+func (p PrecopyPolicy) converged(round int, dirty, prevDirty int64, elapsed time.Duration) bool {
+	if round >= p.MaxRounds {
+		log.Printf("pre-copy reached max rounds %d", p.MaxRounds)
+		return true
+	}
+	if dirty <= p.DirtyThreshold {
+		log.Printf("pre-copy dirty set %d bytes is under threshold %d", dirty, p.DirtyThreshold)
+		return true
+	}
+	if elapsed >= p.TimeBudget {
+		log.Printf("pre-copy ran out of time budget %v", p.TimeBudget)
+		return true
+	}
+	// the container dirties memory faster than we can ship it, more rounds
+	// won't help
+	if round > 1 && dirty >= prevDirty {
+		log.Printf("pre-copy doesn't converge, dirty set grows from %d to %d bytes", prevDirty, dirty)
+		return true
+	}
+	return false
+}
+
+const (
+	// roundsDir is the dir of the checkpoint holding the images of the
+	// pre-dump rounds, one dir per round each linked to the one before
+	roundsDir = "precopy"
+	// checkpointImgDir is the dir of the checkpoint the final dump goes to
+	checkpointImgDir = "img"
+)
+
+// roundDir returns the dir of the images of a pre-dump round
+func roundDir(checkpointDir string, round int) string {
+	return filepath.Join(checkpointDir, roundsDir, strconv.Itoa(round))
+}
+
+// dirtyBytes returns the size of the pages images in the dir of a pre-dump
+// round, i.e. the pages dirtied since the round before.
+func dirtyBytes(dir string) (int64, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return 0, err
+	}
+	var total int64
+	for _, e := range entries {
+		if !e.Type().IsRegular() || !strings.HasPrefix(e.Name(), "pages-") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+// clearRounds removes the pre-dump rounds an earlier migration left in the
+// checkpoint, they belong to the user so they're removed as the user
+func clearRounds(ctx context.Context, userName, checkpointDir string) error {
+	dir := filepath.Join(checkpointDir, roundsDir)
+	return util.RunCmdAsUser(ctx, exec.CommandContext(ctx, "rm", "-rf", dir), userName)
+}
+
+// AsyncImgs pre-dumps the container of mg while it keeps running and ships
+// every round to target, until policy tells the final dump is due or the
+// migration is canceled. Every round goes into a dir of its own with only
+// the pages dirtied since the round before. It returns the rounds taken, a
+// failure is recorded in mg.
+func (m *Migrator) AsyncImgs(mg *migration, checkpointDir, target string, policy PrecopyPolicy) (int, error) {
+	userName, instanceName := mg.entry.UserName, mg.entry.InstanceName
+	start := time.Now()
+	ctx, cancel := mg.withTimeout(StepPreDump, false)
+	err := clearRounds(ctx, userName, checkpointDir)
+	cancel()
+	if err != nil {
+		log.Printf("failed to clear pre-dump rounds of checkpoint %s: %v", mg.entry.Checkpoint, err)
+		mg.fail(ErrCheckpoint, StepPreDump, err)
+		return 0, err
+	}
+	var prevDirty int64
+	for round := 1; ; round++ {
+		if mg.canceled() {
+			return round - 1, nil
+		}
+		roundStart := time.Now()
+		opts := CheckpointOptions{PreDump: true, ImagesDir: roundDir(checkpointDir, round)}
+		if round > 1 {
+			opts.PrevImagesDir = filepath.Join("..", strconv.Itoa(round-1))
+		}
+		ctx, cancel := mg.withTimeout(StepPreDump, false)
+		err = m.timedOut(ctx, StepPreDump, m.runtime().Checkpoint(ctx, userName, instanceName, opts))
+		cancel()
+		if err != nil {
+			log.Printf("failed to pre-dump instance %s in round %d: %v", instanceName, round, err)
+			mg.fail(ErrDumpFailed, StepPreDump, err)
+			return round - 1, err
+		}
+		dirty, err := dirtyBytes(opts.ImagesDir)
+		if err != nil {
+			log.Printf("failed to measure dirty pages of checkpoint %s: %v", mg.entry.Checkpoint, err)
+			mg.fail(ErrCheckpoint, StepPreDump, err)
+			return round - 1, err
+		}
+		err = m.syncCheckpoint(mg, checkpointDir, target)
+		if err != nil {
+			log.Printf("failed to ship pre-dump images of round %d to %s: %v", round, target, err)
+			mg.fail(ErrTransferFailed, StepTransfer, err)
+			return round - 1, err
+		}
+		log.Printf("pre-dump round %d of instance %s: %d dirty bytes in %v", round, instanceName, dirty, time.Since(roundStart))
+		if policy.converged(round, dirty, prevDirty, time.Since(start)) {
+			return round, nil
+		}
+		prevDirty = dirty
+	}
+}
+
+func (m *Migrator) precopyMigrate(mg *migration, req *PrecopyMigrateRequest, res *PrecopyMigrateResponse) error {
+	log.Printf("pre-copy migrate request received: %v", req)
+	policy := newPrecopyPolicy(req)
+	if err := mg.start(); err != nil {
+		log.Printf("%v", err)
+		mg.fail(ErrCanceled, StepQueue, err)
+		res.Status = CANCELED
+		return nil
+	}
+
+	instance, err := m.runtime().Instance(req.UserName, req.InstanceName)
+	if err != nil {
+		log.Printf("failed to get checkpoint name of instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		return mg.fail(ErrInstanceNotFound, StepLookup, err)
+	}
+	checkpointDir, err := apptainer.GetCheckpointDir(req.UserName, instance.Checkpoint)
+	if err != nil {
+		log.Printf("failed to get checkpoint dir of instance %s: %v", req.InstanceName, err)
+		res.Status = FAIL
+		return mg.fail(ErrCheckpoint, StepLookup, err)
+	}
+	mg.setInstance(instance.Checkpoint, instance.Image)
+
+	// 1. pre-dump the container while it keeps running and ship the rounds
+	start := time.Now()
+	res.Rounds, err = m.AsyncImgs(mg, checkpointDir, req.Target, policy)
+	mg.report.PreDump = time.Since(start)
+	mg.report.PreDumpRounds = res.Rounds
+	if err != nil || mg.canceled() {
+		// the container kept running, the checkpoint holds no full dump
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
+	}
+
+	// 2. freeze and dump the container on top of the last round, only the
+	// pages dirtied since are left
+	prev, err := filepath.Rel(filepath.Join(checkpointDir, checkpointImgDir), roundDir(checkpointDir, res.Rounds))
+	if err != nil {
+		res.Status = FAIL
+		return mg.fail(ErrCheckpoint, StepDump, err)
+	}
+	mg.frozen()
+	start = time.Now()
+	ctx, cancel := mg.withTimeout(StepDump, false)
+	err = m.timedOut(ctx, StepDump, m.runtime().Checkpoint(ctx, req.UserName, req.InstanceName, CheckpointOptions{PrevImagesDir: prev}))
+	cancel()
+	mg.report.Dump = time.Since(start)
+	if err != nil {
+		log.Printf("failed to dump instance %s: %v", req.InstanceName, err)
+		mg.fail(ErrDumpFailed, StepDump, err)
+		res.Status = m.rollback(mg, instance, nil, false)
+		return nil
+	}
+	log.Printf("dump instance %s to checkpoint %s after %d pre-dump rounds", req.InstanceName, instance.Checkpoint, res.Rounds)
+	mg.phase(PhaseDumped)
+
+	// 3. stop the container, the checkpoint is complete so the source can
+	// restart from it if the target fails
+	stopped := mg.stopSource()
+	mg.phase(PhaseSourceStopped)
+
+	// 4. ship the rest of the images
+	err = m.syncCheckpoint(mg, checkpointDir, req.Target)
+	if err != nil {
+		log.Printf("failed to rsync checkpoint %s to %s: %v", instance.Checkpoint, req.Target, err)
+		mg.fail(ErrTransferFailed, StepTransfer, err)
+		res.Status = m.rollback(mg, instance, stopped, true)
+		return nil
+	}
+	mg.phase(PhaseTransferred)
+	if mg.canceled() {
+		res.Status = m.rollback(mg, instance, stopped, true)
+		return nil
+	}
+
+	// 5. request the server to restore the container
+	ctx, cancel = mg.withTimeout(StepConnect, true)
+	client, err := m.dialPeer(ctx, req.Target)
+	cancel()
+	if err != nil {
+		log.Printf("failed to connect to server: %v", err)
+		mg.fail(ErrUnreachable, StepConnect, err)
+		res.Status = m.rollback(mg, instance, stopped, true)
+		return nil
+	}
+	defer client.Close()
+
+	r := RestartContainerResponse{}
+	start = time.Now()
+	ctx, cancel = m.callContext(StepRestore)
+	err = call(ctx, client, "Migrator.RestartContainer", &RestartContainerRequest{
+		MigrationID:    mg.entry.ID,
+		UserName:       req.UserName,
+		InstanceName:   req.InstanceName,
+		CheckpointName: instance.Checkpoint,
+		ImagePath:      instance.Image,
+		Synced:         m.syncsNatively(),
+		Images:         mg.images,
+		Timeout:        m.Timeouts.of(StepRestore),
+	}, &r)
+	cancel()
+	mg.report.Restore = time.Since(start)
+	if err != nil || r.Status != OK {
+		log.Printf("failed to restart container %s: %v", req.InstanceName, err)
+		mg.failRemote(ErrRestoreFailed, StepRestore, err, r.Err)
+		if errors.Is(err, context.DeadlineExceeded) {
+			// the target may still be restarting it
+			m.stopRemoteInstance(client, mg.entry.ID, req.UserName, req.InstanceName)
+		}
+		res.Status = m.rollback(mg, instance, stopped, true)
+		return nil
+	}
+	mg.resumed()
+	log.Printf("restart container %s successfully", req.InstanceName)
+	mg.phase(PhaseRestarted)
+	<-stopped
+	res.Status = OK
+	return nil
+}
@@ -0,0 +1,94 @@
+package migrator
+
+import (
+	"cr/apptainer"
+	"cr/util"
+	"fmt"
+	"os"
+	"os/user"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConverged(t *testing.T) {
+	p := PrecopyPolicy{MaxRounds: 5, DirtyThreshold: 1 << 20, TimeBudget: time.Minute}
+	tests := []struct {
+		name             string
+		round            int
+		dirty, prevDirty int64
+		elapsed          time.Duration
+		want             bool
+	}{
+		{"first round", 1, 100 << 20, 0, time.Second, false},
+		{"shrinking", 2, 50 << 20, 100 << 20, time.Second, false},
+		{"max rounds", 5, 50 << 20, 100 << 20, time.Second, true},
+		{"under threshold", 2, 1 << 20, 100 << 20, time.Second, true},
+		{"out of time", 2, 50 << 20, 100 << 20, time.Minute, true},
+		{"growing", 2, 100 << 20, 50 << 20, time.Second, true},
+		{"steady", 3, 50 << 20, 50 << 20, time.Second, true},
+		{"growing first round", 1, 100 << 20, 200 << 20, time.Second, false},
+	}
+	for _, tt := range tests {
+		if got := p.converged(tt.round, tt.dirty, tt.prevDirty, tt.elapsed); got != tt.want {
+			t.Errorf("%s: converged = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestPrecopyMigrate(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tgt := NewFakeRuntime()
+	serveTarget(t, tgt)
+	src := NewFakeRuntime()
+	src.PreDumpPages = []int64{8 << 20, 4 << 20, 2 << 20, 512 << 10}
+	checkpoint := "precopy-test-" + util.NewID()
+	src.AddInstance(u.Username, apptainer.File{Name: "app", Image: "/images/app.sif", Checkpoint: checkpoint})
+	checkpointDir, err := apptainer.GetCheckpointDir(u.Username, checkpoint)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(checkpointDir) })
+	// the rounds of an earlier migration must not be linked to
+	stale := roundDir(checkpointDir, 7)
+	if err := os.MkdirAll(stale, 0o755); err != nil {
+		t.Skipf("can't create a checkpoint dir: %v", err)
+	}
+	m := &Migrator{IsSharedFS: true, Runtime: src}
+
+	job := runJob(t, m, StartMigrationRequest{Mode: ModePrecopy, UserName: u.Username, InstanceName: "app", Target: "127.0.0.2", DirtyThreshold: 1 << 20})
+	if job.Result != OK || job.Report.PreDumpRounds != 4 {
+		t.Fatalf("status %v after %d rounds, want OK after 4: %v", job.Result, job.Report.PreDumpRounds, job.Err)
+	}
+	if _, err := os.Stat(stale); !os.IsNotExist(err) {
+		t.Errorf("stale round left: %v", err)
+	}
+	// every round links to the one before, the final dump to the last one
+	want := []CheckpointOptions{
+		{PreDump: true, ImagesDir: roundDir(checkpointDir, 1)},
+		{PreDump: true, ImagesDir: roundDir(checkpointDir, 2), PrevImagesDir: "../1"},
+		{PreDump: true, ImagesDir: roundDir(checkpointDir, 3), PrevImagesDir: "../2"},
+		{PreDump: true, ImagesDir: roundDir(checkpointDir, 4), PrevImagesDir: "../3"},
+		{PrevImagesDir: "../precopy/4"},
+	}
+	var got []string
+	for _, c := range src.Calls() {
+		if strings.HasPrefix(c, "Checkpoint ") {
+			got = append(got, c)
+		}
+	}
+	if len(got) != len(want) {
+		t.Fatalf("checkpoint calls = %q, want %d", got, len(want))
+	}
+	for i, opts := range want {
+		if w := strings.TrimSpace(fmt.Sprintln("Checkpoint", "app", opts)); got[i] != w {
+			t.Errorf("checkpoint call %d = %q, want %q", i+1, got[i], w)
+		}
+	}
+	if !hasCalls(src.Calls(), "Checkpoint", "Stop") || !hasCalls(tgt.Calls(), "Restart") {
+		t.Errorf("calls: source %q, target %q", src.Calls(), tgt.Calls())
+	}
+}
@@ -0,0 +1,140 @@
+package migrator
+
+import (
+	"cr/apptainer"
+	"cr/transfer"
+	"cr/util"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+)
+
+// Preflight checks that a migration can go before anything touches the
+// container, every failed check is reported in Problems
+func (m *Migrator) Preflight(req *PreflightRequest, res *PreflightResponse) error {
+	log.Printf("preflight request received: %v", req)
+	if req.Mode == "" {
+		req.Mode = ModeMigrate
+	}
+	problem := func(format string, a ...interface{}) {
+		res.Problems = append(res.Problems, fmt.Sprintf(format, a...))
+	}
+	defer func() {
+		if len(res.Problems) == 0 {
+			res.Status = OK
+		} else {
+			res.Status = FAIL
+		}
+	}()
+
+	// 1. the instance runs on the source
+	instance, err := m.runtime().Instance(req.UserName, req.InstanceName)
+	if err != nil {
+		problem("instance %s isn't running: %v", req.InstanceName, err)
+		return nil
+	}
+	checkpointDir, err := apptainer.GetCheckpointDir(req.UserName, instance.Checkpoint)
+	if err != nil {
+		problem("can't find checkpoint dir of instance %s: %v", req.InstanceName, err)
+		return nil
+	}
+
+	// 2. diskless migration needs a checkpoint in memory mode
+	if req.Mode == ModeDiskless {
+		if _, err := apptainer.GetImageRealPath(checkpointDir); err != nil {
+			problem("checkpoint %s isn't in memory mode: %v", instance.Checkpoint, err)
+		}
+	}
+	if !m.IsSharedFS && m.Sync == SyncRsync {
+		if _, err := exec.LookPath("rsync"); err != nil {
+			problem("rsync isn't available on the source: %v", err)
+		}
+	}
+
+	// 3. the checkpoint is about as large as the memory of the container
+	var bytes int64
+	if instance.Pid > 0 {
+		bytes, err = util.ProcessTreeRSS(instance.Pid)
+		if err != nil {
+			log.Printf("failed to estimate memory of instance %s: %v", req.InstanceName, err)
+		}
+	}
+
+	// 4. the target is reachable, compatible and has room for the checkpoint
+	r := TargetCheckResponse{}
+	err = m.queryPeer(req.Target, "Migrator.TargetCheck", &TargetCheckRequest{
+		Version:         ProtocolVersion,
+		TransferVersion: transfer.Version,
+		UserName:        req.UserName,
+		InstanceName:    req.InstanceName,
+		CheckpointName:  instance.Checkpoint,
+		ImagePath:       instance.Image,
+		Diskless:        req.Mode == ModeDiskless,
+		Bytes:           bytes,
+	}, &r)
+	if err != nil {
+		problem("target server %s can't run the checks: %v", req.Target, err)
+		return nil
+	}
+	// a target of another version may not check the versions itself
+	if r.Version != ProtocolVersion || r.TransferVersion != transfer.Version {
+		problem("target speaks protocol version %d and transfer version %d, source speaks %d and %d",
+			r.Version, r.TransferVersion, ProtocolVersion, transfer.Version)
+		return nil
+	}
+	res.Problems = append(res.Problems, r.Problems...)
+	return nil
+}
+
+// TargetCheck runs the preflight checks of the target node
+func (m *Migrator) TargetCheck(req *TargetCheckRequest, res *TargetCheckResponse) error {
+	res.Version = ProtocolVersion
+	res.TransferVersion = transfer.Version
+	problem := func(format string, a ...interface{}) {
+		res.Problems = append(res.Problems, fmt.Sprintf(format, a...))
+	}
+	defer func() {
+		if len(res.Problems) == 0 {
+			res.Status = OK
+		} else {
+			res.Status = FAIL
+		}
+	}()
+
+	if req.Version != ProtocolVersion {
+		problem("target speaks protocol version %d, source speaks %d", ProtocolVersion, req.Version)
+	}
+	if req.TransferVersion != transfer.Version {
+		problem("target speaks transfer version %d, source speaks %d", transfer.Version, req.TransferVersion)
+	}
+	if len(res.Problems) > 0 {
+		return nil
+	}
+	if _, err := os.Stat(req.ImagePath); err != nil {
+		problem("image %s isn't available on the target: %v", req.ImagePath, err)
+	}
+	if m.isRunning(req.UserName, req.InstanceName) {
+		problem("instance %s already runs on the target", req.InstanceName)
+	}
+
+	// a diskless checkpoint lands on tmpfs, the others in the checkpoint dir
+	dir := apptainer.TmpfsDir
+	if !req.Diskless {
+		checkpointDir, err := apptainer.GetCheckpointDir(req.UserName, req.CheckpointName)
+		if err != nil {
+			problem("can't find checkpoint dir for user %s: %v", req.UserName, err)
+			return nil
+		}
+		dir = checkpointDir
+	}
+	free, err := util.FreeBytes(dir)
+	if err != nil {
+		problem("can't get free space at %s: %v", dir, err)
+		return nil
+	}
+	if free < req.Bytes {
+		problem("%s has %d bytes free, the checkpoint needs about %d", dir, free, req.Bytes)
+	}
+	return nil
+}
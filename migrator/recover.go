@@ -0,0 +1,121 @@
+package migrator
+
+import (
+	"context"
+	"cr/apptainer"
+	"log"
+)
+
+// Recover resolves the migrations a previous run of the server left
+// unfinished. Each one is finished, rolled back or, when the peer can't be
+// reached, reported and kept in the journal for the next start.
+func (m *Migrator) Recover() error {
+	if m.Journal == nil {
+		return nil
+	}
+	entries, err := m.Journal.Unfinished()
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		log.Printf("recover %s migration %s of instance %s in phase %s", e.Role, e.ID, e.InstanceName, e.Phase)
+		ctx := m.logContext(context.Background(), e.ID, e.UserName)
+		mg := &migration{m: m, ctx: ctx, base: ctx, entry: e}
+		if e.Role == RoleTarget {
+			m.recoverTarget(mg)
+		} else {
+			m.recoverSource(mg)
+		}
+	}
+	remaining, err := m.Journal.Unfinished()
+	if err != nil {
+		return err
+	}
+	return m.Journal.Compact(remaining)
+}
+
+func (m *Migrator) InstanceStatus(req *InstanceStatusRequest, res *InstanceStatusResponse) error {
+	res.Running = m.isRunning(req.UserName, req.InstanceName)
+	res.Status = OK
+	return nil
+}
+
+func (m *Migrator) isRunning(userName, instanceName string) bool {
+	_, err := m.runtime().Instance(userName, instanceName)
+	return err == nil
+}
+
+func (m *Migrator) recoverSource(mg *migration) {
+	e := mg.entry
+	ctx, cancel := context.WithTimeout(context.Background(), m.Timeouts.of(StepConnect))
+	defer cancel()
+	client, err := m.dialPeer(ctx, e.Target)
+	if err != nil {
+		log.Printf("can't reach target %s of migration %s, instance %s is left in phase %s: %v", e.Target, e.ID, e.InstanceName, e.Phase, err)
+		return
+	}
+	defer client.Close()
+	r := InstanceStatusResponse{}
+	err = call(ctx, client, "Migrator.InstanceStatus", &InstanceStatusRequest{
+		UserName:     e.UserName,
+		InstanceName: e.InstanceName,
+	}, &r)
+	if err != nil {
+		log.Printf("can't get status of instance %s on %s, migration %s is left in phase %s: %v", e.InstanceName, e.Target, e.ID, e.Phase, err)
+		return
+	}
+	localRunning := m.isRunning(e.UserName, e.InstanceName)
+
+	// the target took over, finish the migration
+	if r.Running && (e.Phase == PhaseRestarted || !localRunning) {
+		if localRunning {
+			<-m.stopInstance(mg.base, e.UserName, e.InstanceName)
+			mg.phase(PhaseSourceStopped)
+		}
+		log.Printf("migration %s of instance %s finished on %s", e.ID, e.InstanceName, e.Target)
+		mg.phase(PhaseDone)
+		return
+	}
+
+	// the source still runs the instance, drop whatever the target has
+	if localRunning {
+		m.stopRemoteInstance(client, e.ID, e.UserName, e.InstanceName)
+		log.Printf("migration %s of instance %s rolled back, it keeps running on the source", e.ID, e.InstanceName)
+		mg.phase(PhaseRolledBack)
+		return
+	}
+
+	// the instance runs nowhere, restart it from the local checkpoint if it
+	// holds the whole memory
+	instance := &apptainer.File{Name: e.InstanceName, Checkpoint: e.Checkpoint, Image: e.Image}
+	complete := e.Checkpoint != "" && (e.Mode == ModeMigrate || e.Mode == ModePrecopy) && e.Phase != PhaseStarted && e.Phase != PhaseQueued
+	if complete {
+		m.stopRemoteInstance(client, e.ID, e.UserName, e.InstanceName)
+		mg.finish(m.rollback(mg, instance, nil, true), nil)
+		return
+	}
+	if e.Phase == PhaseStarted || e.Phase == PhaseQueued {
+		// nothing was dumped yet, the instance was gone before the migration
+		mg.phase(PhaseFailed)
+		return
+	}
+	log.Printf("instance %s of migration %s runs nowhere and can't be recovered from checkpoint %s", e.InstanceName, e.ID, e.Checkpoint)
+	mg.phase(PhaseFailed)
+}
+
+func (m *Migrator) recoverTarget(mg *migration) {
+	e := mg.entry
+	switch e.Phase {
+	case PhasePageServerLaunched:
+		// the restore never came, tear down the page server
+		log.Printf("stop page server of instance %s left by migration %s", e.InstanceName, e.ID)
+		<-m.stopInstance(mg.base, e.UserName, e.InstanceName)
+		mg.phase(PhaseFailed)
+	default:
+		if m.isRunning(e.UserName, e.InstanceName) {
+			mg.phase(PhaseDone)
+		} else {
+			mg.phase(PhaseFailed)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package migrator
+
+import (
+	"cr/transfer"
+	"time"
+)
+
+// Report holds the timings and the traffic of a migration, phases the mode
+// doesn't go through stay zero
+type Report struct {
+	Mode string
+	// PreDump is the time spent in pre-dump rounds of a pre-copy migration
+	PreDump       time.Duration
+	PreDumpRounds int
+	Dump          time.Duration
+	Stop          time.Duration
+	// Transfer is the time spent syncing the checkpoint dir to the target
+	Transfer   time.Duration
+	PageServer time.Duration
+	// ImageSend is the time spent sending the images of a diskless dump
+	ImageSend time.Duration
+	Restore   time.Duration
+	// Downtime runs from the freeze of the container on the source until it
+	// runs again on the target
+	Downtime time.Duration
+	Total    time.Duration
+	// BytesTransferred counts the bytes sent to the target by the migrator,
+	// pages sent by criu itself aren't included
+	BytesTransferred int64
+	// BytesRaw counts the same bytes before compression
+	BytesRaw int64
+	// Codec compressed them, CompressionRatio is BytesRaw over
+	// BytesTransferred
+	Codec            string
+	CompressionRatio float64
+}
+
+// sent accounts for a transfer to the target. A codec auto picked is kept
+// for the rest of the migration.
+func (mg *migration) sent(stats transfer.Stats) {
+	mg.report.BytesTransferred += stats.Wire
+	mg.report.BytesRaw += stats.Raw
+	if stats.Codec.Name != "" && stats.Codec.Name != transfer.CodecAuto {
+		mg.codec = stats.Codec
+		mg.report.Codec = stats.Codec.String()
+	}
+	if mg.report.BytesTransferred > 0 {
+		mg.report.CompressionRatio = float64(mg.report.BytesRaw) / float64(mg.report.BytesTransferred)
+	}
+}
+
+// frozen marks the moment the container stops making progress
+func (mg *migration) frozen() {
+	mg.frozenAt = time.Now()
+}
+
+// stopSource stops the instance on the source in the background, the stop
+// is timed once the returned channel delivers
+func (mg *migration) stopSource() <-chan error {
+	done := make(chan error, 1)
+	start := time.Now()
+	stopped := mg.m.stopInstance(mg.base, mg.entry.UserName, mg.entry.InstanceName)
+	go func() {
+		err := <-stopped
+		mg.report.Stop = time.Since(start)
+		done <- err
+	}()
+	return done
+}
+
+// resumed marks the moment the container runs again on the target
+func (mg *migration) resumed() {
+	if !mg.frozenAt.IsZero() {
+		mg.report.Downtime = time.Since(mg.frozenAt)
+	}
+}
@@ -0,0 +1,113 @@
+package migrator
+
+import (
+	"context"
+	"cr/apptainer"
+	"log"
+	"net/rpc"
+	"time"
+)
+
+const (
+	// restoreGrace is how long Restore watches the restored container for an
+	// early failure before it reports success
+	restoreGrace = 3 * time.Second
+)
+
+// stopInstance stops the instance in the background, the returned channel
+// delivers the result once the instance is gone or the stop timed out.
+func (m *Migrator) stopInstance(ctx context.Context, userName, instanceName string) <-chan error {
+	done := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(ctx, m.Timeouts.of(StepStop))
+		defer cancel()
+		err := m.timedOut(ctx, StepStop, m.runtime().Stop(ctx, userName, instanceName))
+		if err != nil {
+			log.Printf("failed to stop instance %s: %v", instanceName, err)
+		}
+		done <- err
+	}()
+	return done
+}
+
+// rollback brings the instance back on the source after the target failed to
+// take it over. If the instance still runs it's simply kept, otherwise it's
+// restarted from the local checkpoint when the checkpoint holds the whole
+// memory. stopped is the pending stop of the source instance, nil if the
+// source was never stopped. A canceled migration which made it back to the
+// source reports CANCELED.
+func (m *Migrator) rollback(mg *migration, instance *apptainer.File, stopped <-chan error, localCheckpoint bool) Status {
+	status := m.restoreSource(mg.base, mg.entry.UserName, instance, stopped, localCheckpoint)
+	if status == ROLLEDBACK && mg.canceled() {
+		return CANCELED
+	}
+	return status
+}
+
+func (m *Migrator) restoreSource(ctx context.Context, userName string, instance *apptainer.File, stopped <-chan error, localCheckpoint bool) Status {
+	if stopped == nil {
+		if _, err := m.runtime().Instance(userName, instance.Name); err == nil {
+			log.Printf("instance %s keeps running on the source", instance.Name)
+			return ROLLEDBACK
+		}
+	} else {
+		// don't race with the stop, the restarted instance has the same name
+		<-stopped
+	}
+	if !localCheckpoint {
+		log.Printf("instance %s is gone and its checkpoint is incomplete, can't roll back", instance.Name)
+		return FAIL
+	}
+	ctx, cancel := context.WithTimeout(ctx, m.Timeouts.of(StepRestore))
+	defer cancel()
+	err := m.runtime().Restart(ctx, userName, instance.Name, instance.Checkpoint, instance.Image, RestartOptions{})
+	if err != nil {
+		log.Printf("failed to roll back instance %s from checkpoint %s: %v", instance.Name, instance.Checkpoint, err)
+		return FAIL
+	}
+	log.Printf("instance %s rolled back from checkpoint %s", instance.Name, instance.Checkpoint)
+	return ROLLEDBACK
+}
+
+// stopRemoteInstance asks the target to drop what's left of a failed
+// migration, e.g. a page server waiting for pages.
+func (m *Migrator) stopRemoteInstance(client *rpc.Client, migrationID, userName, instanceName string) {
+	ctx, cancel := m.callContext(StepStop)
+	defer cancel()
+	r := StopInstanceResponse{}
+	err := call(ctx, client, "Migrator.StopInstance", &StopInstanceRequest{
+		MigrationID:  migrationID,
+		UserName:     userName,
+		InstanceName: instanceName,
+	}, &r)
+	if err == nil && r.Status != OK {
+		err = r.Err
+	}
+	if err != nil {
+		log.Printf("failed to stop instance %s on the target: %v", instanceName, err)
+	}
+}
+
+func (m *Migrator) StopInstance(req *StopInstanceRequest, res *StopInstanceResponse) error {
+	ctx := context.Background()
+	if req.MigrationID != "" {
+		if err := validMigrationID(req.MigrationID); err != nil {
+			res.Status = FAIL
+			res.Err = newError(ErrInvalidRequest, StepStop, err)
+			return nil
+		}
+		// the source gave up on the migration
+		mg := m.newMigration(req.MigrationID, RoleTarget, "", req.UserName, req.InstanceName, "")
+		defer mg.finish(FAIL, nil)
+		ctx = mg.base
+	}
+	err := <-m.stopInstance(ctx, req.UserName, req.InstanceName)
+	if err != nil {
+		res.Status = FAIL
+		res.Err = newError(ErrStopFailed, StepStop, err)
+		return nil
+	}
+	log.Printf("stop instance %s successfully", req.InstanceName)
+	res.Status = OK
+	return nil
+}
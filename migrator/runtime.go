@@ -0,0 +1,62 @@
+package migrator
+
+import (
+	"context"
+	"cr/apptainer"
+)
+
+type CheckpointOptions struct {
+	// PreDump dumps the memory only and leaves the container running
+	PreDump bool
+	// ImagesDir is where the images go instead of the image dir of the
+	// checkpoint, it's created if missing
+	ImagesDir string
+	// PrevImagesDir is the dir of the previous pre-dump, relative to where
+	// the images go. The dump then only contains the pages dirtied since
+	// and links to it for the rest.
+	PrevImagesDir string
+	// PageServer sends the memory pages to the page server at Address
+	PageServer bool
+	// LazyPages dumps the container without its memory pages and serves them
+	// from a lazy-pages server on Address until the restored container has
+	// all of them. The call only returns once every page is handed out
+	LazyPages bool
+	Address   string
+}
+
+type RestartOptions struct {
+	// LazyPages faults the memory pages in from the lazy-pages server at
+	// Address
+	LazyPages bool
+	Address   string
+}
+
+// ContainerRuntime is what the migrator needs from the container runtime on
+// a node. Calls bound to ctx are aborted once ctx is done.
+type ContainerRuntime interface {
+	// Instance returns the instance if it's running
+	Instance(userName, instanceName string) (*apptainer.File, error)
+	// Checkpoint dumps the instance into its checkpoint
+	Checkpoint(ctx context.Context, userName, instanceName string, opts CheckpointOptions) error
+	// Stop stops the instance
+	Stop(ctx context.Context, userName, instanceName string) error
+	// Restart starts the instance from the checkpoint
+	Restart(ctx context.Context, userName, instanceName, checkpointName, imagePath string, opts RestartOptions) error
+	// LaunchPageServer starts the instance in page-server mode, it waits for
+	// the pages of a diskless dump
+	LaunchPageServer(ctx context.Context, userName, instanceName, checkpointName, imagePath string) error
+	// Restore restores the instance launched by LaunchPageServer once the
+	// rest of its images arrived
+	Restore(ctx context.Context, userName, instanceName string) error
+	// ConfigureCheckpoint sets the storage mode of the checkpoint, e.g.
+	// "memory" for a checkpoint on tmpfs
+	ConfigureCheckpoint(ctx context.Context, userName, checkpointName, mode string) error
+}
+
+// runtime returns the runtime of the migrator, apptainer by default
+func (m *Migrator) runtime() ContainerRuntime {
+	if m.Runtime == nil {
+		return ApptainerRuntime{}
+	}
+	return m.Runtime
+}
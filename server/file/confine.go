@@ -0,0 +1,172 @@
+package file
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// owner is the user the files of a connection belong to
+type owner struct {
+	name  string
+	uid   int
+	gid   int
+	roots []string
+}
+
+// lookupOwner resolves the user a sender names and the roots its files may
+// be written under. A "~" root stands for the home of the user.
+func lookupOwner(name string, roots []string) (*owner, error) {
+	if name == "" {
+		return nil, fmt.Errorf("sender named no user")
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	o := &owner{name: name}
+	o.uid, err = strconv.Atoi(u.Uid)
+	if err != nil {
+		return nil, err
+	}
+	o.gid, err = strconv.Atoi(u.Gid)
+	if err != nil {
+		return nil, err
+	}
+	for _, root := range roots {
+		if root == "~" || strings.HasPrefix(root, "~/") {
+			root = filepath.Join(u.HomeDir, root[1:])
+		}
+		// the roots are trusted, resolve their own symlinks
+		real, err := filepath.EvalSymlinks(root)
+		if err != nil {
+			continue
+		}
+		o.roots = append(o.roots, real)
+	}
+	if len(o.roots) == 0 {
+		return nil, fmt.Errorf("no checkpoint root exists for user %s", name)
+	}
+	return o, nil
+}
+
+// confine returns where the file named name goes. It must be an absolute
+// path under one of the roots of the owner, symlinks included, and the
+// directories on the way which already exist must belong to the owner.
+func (o *owner) confine(name string) (string, error) {
+	if !filepath.IsAbs(name) {
+		return "", fmt.Errorf("%s isn't absolute", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%s escapes with ..", name)
+		}
+	}
+	path := filepath.Clean(name)
+	// resolve the part which exists, the rest is created by us
+	existing := path
+	var rest []string
+	for {
+		_, err := os.Lstat(existing)
+		if err == nil {
+			break
+		}
+		if !os.IsNotExist(err) || existing == "/" {
+			return "", err
+		}
+		rest = append([]string{filepath.Base(existing)}, rest...)
+		existing = filepath.Dir(existing)
+	}
+	real, err := filepath.EvalSymlinks(existing)
+	if err != nil {
+		return "", err
+	}
+	for _, root := range o.roots {
+		if real != root && !strings.HasPrefix(real, root+string(filepath.Separator)) {
+			continue
+		}
+		err = o.owns(root, real)
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(append([]string{real}, rest...)...), nil
+	}
+	return "", fmt.Errorf("%s is outside of the checkpoint roots of user %s", name, o.name)
+}
+
+// confineEntry returns where the entry named name goes like confine, but
+// doesn't follow a symlink at name itself. What is already at name must
+// belong to the owner unless it's a root, and may only be a symlink if the
+// entry is a symlink replacing it: the owner may have put it there to lead
+// the server elsewhere.
+func (o *owner) confineEntry(name string, symlink bool) (string, error) {
+	if !filepath.IsAbs(name) {
+		return "", fmt.Errorf("%s isn't absolute", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("%s escapes with ..", name)
+		}
+	}
+	name = filepath.Clean(name)
+	if o.isRoot(name) {
+		// its parent is outside of the roots
+		return name, nil
+	}
+	if name == "/" {
+		return "", fmt.Errorf("/ is outside of the checkpoint roots of user %s", o.name)
+	}
+	dir, err := o.confine(filepath.Dir(name))
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, filepath.Base(name))
+	if o.isRoot(path) {
+		return path, nil
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return path, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); !ok || int(st.Uid) != o.uid {
+		return "", fmt.Errorf("%s doesn't belong to user %s", path, o.name)
+	}
+	if info.Mode()&os.ModeSymlink != 0 && !symlink {
+		return "", fmt.Errorf("%s is a symlink", path)
+	}
+	return path, nil
+}
+
+// isRoot tells whether path is one of the roots of the owner, those are
+// never replaced, chmoded or chowned
+func (o *owner) isRoot(path string) bool {
+	for _, root := range o.roots {
+		if path == root {
+			return true
+		}
+	}
+	return false
+}
+
+// owns checks the directories from root down to path belong to the owner,
+// root itself excepted
+func (o *owner) owns(root, path string) error {
+	for p := path; p != root; p = filepath.Dir(p) {
+		info, err := os.Lstat(p)
+		if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || int(st.Uid) != o.uid {
+			return fmt.Errorf("%s doesn't belong to user %s", p, o.name)
+		}
+	}
+	return nil
+}
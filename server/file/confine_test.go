@@ -0,0 +1,162 @@
+package file
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testOwner returns the current user as an owner with a fresh root, and a
+// dir outside of it
+func testOwner(t *testing.T) (*owner, string, string) {
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	outside, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"sub", "other"} {
+		if err := os.Mkdir(filepath.Join(root, dir), 0o755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, file := range []string{"sub/f", "other/f"} {
+		if err := os.WriteFile(filepath.Join(root, file), nil, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for link, target := range map[string]string{"out": outside, "in": filepath.Join(root, "sub")} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	o := &owner{name: "test", uid: os.Getuid(), gid: os.Getgid(), roots: []string{root}}
+	if os.Getuid() == 0 {
+		// other belongs to someone else
+		for _, p := range []string{"other", "other/f"} {
+			if err := os.Lchown(filepath.Join(root, p), 65534, 65534); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	return o, root, outside
+}
+
+func TestConfine(t *testing.T) {
+	o, root, outside := testOwner(t)
+	tests := []struct {
+		name string
+		// want is the path relative to root, err part of the error
+		want string
+		err  string
+		// asRoot only runs as root, which can give files away
+		asRoot bool
+	}{
+		{name: "sub/f", want: "sub/f"},
+		{name: "new/dir/f", want: "new/dir/f"},
+		{name: ".", want: "."},
+		{name: "in/x", want: "sub/x"},
+		{name: "sub/../../x", err: "escapes"},
+		{name: "out/x", err: "outside"},
+		{name: "other/x", err: "doesn't belong", asRoot: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.asRoot && os.Getuid() != 0 {
+				t.Skip("needs root")
+			}
+			got, err := o.confine(root + "/" + tt.name)
+			checkConfined(t, root, got, err, tt.want, tt.err)
+		})
+	}
+	if _, err := o.confine("sub/f"); err == nil {
+		t.Errorf("relative name confined")
+	}
+	if _, err := o.confine(outside); err == nil {
+		t.Errorf("dir outside of the roots confined")
+	}
+}
+
+func TestConfineEntry(t *testing.T) {
+	o, root, _ := testOwner(t)
+	tests := []struct {
+		name string
+		// symlink is whether the entry is a symlink
+		symlink bool
+		want    string
+		err     string
+		asRoot  bool
+	}{
+		{name: "sub/f", want: "sub/f"},
+		{name: "sub/new", want: "sub/new"},
+		{name: "sub/new", symlink: true, want: "sub/new"},
+		// a symlink is only replaced by a symlink, never followed
+		{name: "out", symlink: true, want: "out"},
+		{name: "in", symlink: true, want: "in"},
+		{name: "out", err: "is a symlink"},
+		{name: "in", err: "is a symlink"},
+		{name: "in/f", want: "sub/f"},
+		{name: ".", want: "."},
+		{name: "out/x", err: "outside"},
+		{name: "other", err: "doesn't belong", asRoot: true},
+		{name: "other/f", err: "doesn't belong", asRoot: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.asRoot && os.Getuid() != 0 {
+				t.Skip("needs root")
+			}
+			got, err := o.confineEntry(root+"/"+tt.name, tt.symlink)
+			checkConfined(t, root, got, err, tt.want, tt.err)
+		})
+	}
+	if _, err := o.confineEntry("/", false); err == nil {
+		t.Errorf("/ confined")
+	}
+	if !o.isRoot(root) || o.isRoot(filepath.Join(root, "sub")) {
+		t.Errorf("isRoot doesn't tell the root")
+	}
+}
+
+func checkConfined(t *testing.T, root, got string, err error, want, wantErr string) {
+	t.Helper()
+	if wantErr != "" {
+		if err == nil || !strings.Contains(err.Error(), wantErr) {
+			t.Errorf("got %s, %v, want error with %q", got, err, wantErr)
+		}
+		return
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w := filepath.Join(root, want); got != w {
+		t.Errorf("got %s, want %s", got, w)
+	}
+}
+
+func TestOwns(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root to give files away")
+	}
+	o, root, _ := testOwner(t)
+	tests := []struct {
+		path string
+		ok   bool
+	}{
+		{"", true},
+		{"sub", true},
+		{"sub/f", true},
+		{"other", false},
+		{"other/f", false},
+		{"missing", false},
+	}
+	for _, tt := range tests {
+		err := o.owns(root, filepath.Join(root, tt.path))
+		if (err == nil) != tt.ok {
+			t.Errorf("owns(%q) = %v, want ok %v", tt.path, err, tt.ok)
+		}
+	}
+}
@@ -1,22 +1,38 @@
 package file
 
 import (
+	"cr/transfer"
 	"cr/util"
-	"encoding/binary"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net"
-	"os/exec"
+	"os"
 	"path/filepath"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
-func LaunchFileReceiveServer(port string, wg *sync.WaitGroup) {
+// LaunchFileReceiveServer receives checkpoint files on port, with mutual
+// TLS if config isn't nil and from peers only if that isn't nil. Files may
+// only be written under roots, for the user the sender names, see
+// lookupOwner. tracker, if not nil, follows the sessions of migrations.
+func LaunchFileReceiveServer(port string, roots []string, config *tls.Config, peers util.PeerFilter, tracker Tracker, wg *sync.WaitGroup) {
+	defer wg.Done()
 	// launch a file receive server
 	listener, err := net.Listen("tcp", port)
 	if err != nil {
 		log.Fatalf("Listen error: %v", err)
 	}
+	listener = peers.Listener(listener)
+	if config != nil {
+		listener = tls.NewListener(listener, config)
+	}
 	defer listener.Close()
 
 	for {
@@ -24,53 +40,388 @@ func LaunchFileReceiveServer(port string, wg *sync.WaitGroup) {
 		if err != nil {
 			log.Fatalf("Accept error: %v", err)
 		}
-		go handleConnection(conn)
+		go handleConnection(conn, roots, tracker)
 	}
-	wg.Done()
 }
 
-func handleConnection(conn net.Conn) {
+func handleConnection(conn net.Conn, roots []string, tracker Tracker) {
 	defer conn.Close()
 
-	// 1. read 4 bytes to integer from conn as the length of the file name
-	var fileNameLength int32
-	err := binary.Read(conn, binary.LittleEndian, &fileNameLength)
+	// 1. handshake
+	rc, err := transfer.Accept(conn)
 	if err != nil {
-		log.Printf("failed to read file name length: %v", err)
+		log.Printf("transfer handshake with %v failed: %v", conn.RemoteAddr(), err)
 		return
 	}
-	// 2. read the file name
-	// TODO: decode the file name
-	filePathBuf := make([]byte, fileNameLength)
-	n, err := io.ReadFull(conn, filePathBuf)
+	o, err := lookupOwner(rc.User, roots)
 	if err != nil {
-		log.Printf("failed to read file name: %v", err)
-		return
+		log.Printf("refuse transfer from %v: %v", conn.RemoteAddr(), err)
 	}
-	if n != int(fileNameLength) {
-		log.Printf("failed to read file name, read %d chars, excepted %d", n, fileNameLength)
-		return
+	var sess *session
+	if o != nil && rc.Session != "" {
+		sess = getSession(o.name, rc.Session, rc.Migration, tracker)
 	}
+	// 2. receive entries until the sender is done, answering each one
+	for {
+		hdr, r, err := rc.Next()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			log.Printf("failed to read entry from %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+		if o == nil {
+			err = fmt.Errorf("unknown user %q", rc.User)
+		} else if hdr.Kind == transfer.KindList || hdr.Kind == transfer.KindDigest {
+			if hdr.Kind == transfer.KindList {
+				err = listEntry(o, rc, hdr)
+			} else {
+				err = digestEntry(o, rc, hdr)
+			}
+			if err != nil {
+				log.Printf("failed to answer %v: %v", conn.RemoteAddr(), err)
+				return
+			}
+			continue
+		} else {
+			err = receiveEntry(o, sess, hdr, r)
+		}
+		if err != nil {
+			log.Printf("failed to receive %s: %v", hdr.Name, err)
+			err = rc.Fail(err)
+		} else {
+			log.Printf("received %s, %d bytes", hdr.Name, hdr.Size)
+			err = rc.Ack()
+		}
+		if err != nil {
+			log.Printf("failed to answer %v: %v", conn.RemoteAddr(), err)
+			return
+		}
+	}
+}
 
-	filePath := string(filePathBuf)
+// listEntry answers a list entry with the members of the tree at its path
+// and their digests
+func listEntry(o *owner, rc *transfer.Receiver, hdr *transfer.Header) error {
+	path, err := o.confine(hdr.Name)
+	if err != nil {
+		return rc.Fail(err)
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return rc.Manifest(false, nil)
+	}
+	if err == nil && !info.IsDir() {
+		err = fmt.Errorf("%s isn't a directory", hdr.Name)
+	}
+	if err != nil {
+		return rc.Fail(err)
+	}
+	files, err := transfer.ListDir(path)
+	if err != nil {
+		return rc.Fail(err)
+	}
+	log.Printf("listed %s, %d members", path, len(files))
+	return rc.Manifest(true, files)
+}
 
-	// 3. read the file content
-	err = util.ReceiveFile(conn, filePath)
-	log.Printf("received file %s", filePath)
+// digestEntry answers a digest entry with the digest of the file at its
+// path, if there is a file there
+func digestEntry(o *owner, rc *transfer.Receiver, hdr *transfer.Header) error {
+	path, err := o.confine(hdr.Name)
 	if err != nil {
-		log.Printf("failed to receive file: %v", err)
-		return
+		return rc.Fail(err)
+	}
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) || err == nil && !info.Mode().IsRegular() {
+		return rc.Manifest(false, nil)
 	}
-	// 4. unzip tarball
-	fileDir := filepath.Dir(filePath)
-	fileName := filePath[len(fileDir)+1:]
-	cmd := exec.Command("tar", "-zvxf", fileName)
-	cmd.Dir = fileDir
-	log.Printf("untar file %s to %s", filePath, fileDir)
-	err = cmd.Run()
 	if err != nil {
-		log.Printf("failed to untar file: %v", err)
-		return
+		return rc.Fail(err)
+	}
+	digest, err := transfer.FileDigest(path)
+	if err != nil {
+		return rc.Fail(err)
+	}
+	return rc.Manifest(true, []transfer.FileInfo{{Name: hdr.Name, Kind: transfer.KindFile, Size: info.Size(), Digest: digest}})
+}
+
+// receiveEntry writes the entry to its path, a directory is unpacked as it
+// streams in. Everything written belongs to the owner. Chunks and commits
+// need the session of the connection.
+func receiveEntry(o *owner, sess *session, hdr *transfer.Header, r io.Reader) error {
+	// a tree is entered, an entry replaces what's at its path
+	var path string
+	var err error
+	switch hdr.Kind {
+	case transfer.KindTar, transfer.KindCommit:
+		path, err = o.confine(hdr.Name)
+	default:
+		path, err = o.confineEntry(hdr.Name, hdr.Kind == transfer.KindSymlink)
+	}
+	if err != nil {
+		return err
+	}
+	switch hdr.Kind {
+	case transfer.KindFile, transfer.KindSymlink, transfer.KindChunk:
+		if o.isRoot(path) {
+			return fmt.Errorf("%s is a checkpoint root", path)
+		}
+	}
+	if sess == nil && (hdr.Kind == transfer.KindChunk || hdr.Kind == transfer.KindCommit) {
+		return fmt.Errorf("%s entry outside of a session", hdr.Kind)
+	}
+	switch hdr.Kind {
+	case transfer.KindFile:
+		err := receiveFile(path, o, hdr, r)
+		if err != nil {
+			os.Remove(path)
+		}
+		return err
+	case transfer.KindTar:
+		log.Printf("untar stream to %s", path)
+		err := os.Mkdir(path, os.FileMode(hdr.Mode).Perm())
+		if err == nil {
+			err = os.Lchown(path, o.uid, o.gid)
+		} else if os.IsExist(err) {
+			err = nil
+		}
+		if err != nil {
+			return err
+		}
+		return transfer.ExtractTar(r, path, o.uid, o.gid, func(member string) (string, error) {
+			p, err := o.confineEntry(member, false)
+			if err == nil && o.isRoot(p) {
+				err = fmt.Errorf("tar member %s is a checkpoint root", member)
+			}
+			return p, err
+		})
+	case transfer.KindDir:
+		return receiveDir(path, o, hdr)
+	case transfer.KindSymlink:
+		return receiveSymlink(path, o, hdr, r)
+	case transfer.KindChunk:
+		err := receiveChunk(path, o, hdr, r)
+		if err != nil {
+			return err
+		}
+		sess.landed(path, hdr.Offset, hdr.Size)
+		return nil
+	case transfer.KindCommit:
+		return commit(path, o, sess, hdr, r)
+	}
+	return fmt.Errorf("unknown entry kind %q", hdr.Kind)
+}
+
+// receiveFile writes the content read from r to filePath with the mode of
+// hdr. A content which doesn't match hdr fails the read.
+func receiveFile(filePath string, o *owner, hdr *transfer.Header, r io.Reader) error {
+	// don't write through a symlink left at filePath
+	os.Remove(filePath)
+	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, os.FileMode(hdr.Mode).Perm())
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, r)
+	if err == nil {
+		err = file.Chmod(os.FileMode(hdr.Mode).Perm())
+	}
+	if err == nil {
+		err = file.Chown(o.uid, o.gid)
+	}
+	if err == nil && !hdr.ModTime.IsZero() {
+		err = util.SetFileTime(file, hdr.ModTime)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// receiveChunk writes the chunk read from r into the file at path at its
+// offset, creating the file with the mode of hdr if needed
+func receiveChunk(path string, o *owner, hdr *transfer.Header, r io.Reader) error {
+	if hdr.Offset < 0 || hdr.Size < 0 {
+		return fmt.Errorf("bad chunk of %s at %d", hdr.Name, hdr.Offset)
+	}
+	flags := os.O_CREATE | os.O_WRONLY | syscall.O_NOFOLLOW
+	file, err := os.OpenFile(path, flags, os.FileMode(hdr.Mode).Perm())
+	if errors.Is(err, syscall.ELOOP) {
+		// don't write through a symlink left at path
+		os.Remove(path)
+		file, err = os.OpenFile(path, flags, os.FileMode(hdr.Mode).Perm())
+	}
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err == nil && !info.Mode().IsRegular() {
+		err = fmt.Errorf("%s isn't a regular file", path)
+	}
+	if err == nil {
+		err = file.Chown(o.uid, o.gid)
+	}
+	if err == nil {
+		_, err = file.Seek(hdr.Offset, io.SeekStart)
+	}
+	if err == nil {
+		_, err = io.Copy(file, r)
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// maxCommit bounds the file list of a commit
+const maxCommit = 64 << 20
+
+// commit checks every file a commit lists is complete under the tree at
+// path. Files written in chunks must have all of them, they get their size,
+// mode and modification time then. The session ends with a commit which
+// passes.
+func commit(path string, o *owner, sess *session, hdr *transfer.Header, r io.Reader) error {
+	b, err := io.ReadAll(io.LimitReader(r, maxCommit+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxCommit {
+		return fmt.Errorf("file list of %s is too long", hdr.Name)
+	}
+	var files []struct {
+		Name    string
+		Size    int64
+		Mode    uint32
+		ModTime int64
+	}
+	err = json.Unmarshal(b, &files)
+	if err != nil {
+		return err
+	}
+	var problems []string
+	for _, f := range files {
+		filePath, err := o.confineEntry(hdr.Name+"/"+f.Name, false)
+		if err == nil {
+			err = commitFile(filePath, sess, f.Size, os.FileMode(f.Mode).Perm(), time.Unix(0, f.ModTime))
+		}
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+	if len(problems) > 0 {
+		if len(problems) > 5 {
+			problems = append(problems[:5], fmt.Sprintf("%d more", len(problems)-5))
+		}
+		err = fmt.Errorf("%s is incomplete: %s", path, strings.Join(problems, "; "))
+		if sess.tracked() {
+			sess.tracker.TransferFailed(sess.migration, o.name, sess.id, hdr.Name, err)
+		}
+		return err
+	}
+	log.Printf("committed %s, %d files complete", path, len(files))
+	sess.drop()
+	if sess.tracked() {
+		sess.tracker.TransferCommitted(sess.migration, o.name, sess.id, hdr.Name)
+	}
+	return nil
+}
+
+// commitFile checks the file at path is complete and sets its mode and
+// times. The user may swap the file for a symlink any time, so it's all
+// done on the file opened.
+func commitFile(path string, sess *session, size int64, mode os.FileMode, modTime time.Time) error {
+	// a fifo would block the open
+	file, err := os.OpenFile(path, os.O_WRONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if errors.Is(err, syscall.ELOOP) || errors.Is(err, syscall.ENXIO) {
+		return fmt.Errorf("%s isn't a regular file", path)
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s isn't a regular file", path)
+	}
+	if sess.chunked(path) {
+		err = sess.complete(path, size)
+		if err != nil {
+			return err
+		}
+		// a file which was longer before keeps its tail otherwise
+		err = file.Truncate(size)
+		if err != nil {
+			return err
+		}
+	} else if info.Size() != size {
+		return fmt.Errorf("%s has %d bytes, want %d", path, info.Size(), size)
+	}
+	err = file.Chmod(mode)
+	if err == nil {
+		// tar only keeps whole seconds of the times of batched files
+		err = util.SetFileTime(file, modTime)
+	}
+	return err
+}
+
+// receiveDir creates the directory at path with the mode of hdr, or sets
+// the mode of the one already there unless it's a root
+func receiveDir(path string, o *owner, hdr *transfer.Header) error {
+	mode := os.FileMode(hdr.Mode).Perm()
+	err := os.Mkdir(path, mode)
+	if os.IsExist(err) {
+		var info os.FileInfo
+		info, err = os.Lstat(path)
+		if err == nil && !info.IsDir() {
+			err = fmt.Errorf("%s exists and isn't a directory", path)
+		}
+	}
+	if err != nil || o.isRoot(path) {
+		// the root belongs to whoever set it up, not to the sender
+		return err
+	}
+	dir, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	err = dir.Chmod(mode)
+	if err != nil {
+		return err
+	}
+	return dir.Chown(o.uid, o.gid)
+}
+
+// maxLink bounds the target of a symlink received
+const maxLink = 4096
+
+// receiveSymlink replaces what's at path with a symlink to the target read
+// from r, the target must lie under the checkpoint roots too
+func receiveSymlink(path string, o *owner, hdr *transfer.Header, r io.Reader) error {
+	b, err := io.ReadAll(io.LimitReader(r, maxLink+1))
+	if err != nil {
+		return err
+	}
+	if len(b) > maxLink {
+		return fmt.Errorf("target of symlink %s is too long", hdr.Name)
+	}
+	link := string(b)
+	target := link
+	if !filepath.IsAbs(target) {
+		target = filepath.Join(filepath.Dir(path), target)
+	}
+	_, err = o.confine(target)
+	if err != nil {
+		return fmt.Errorf("symlink %s: %w", hdr.Name, err)
+	}
+	os.Remove(path)
+	err = os.Symlink(link, path)
+	if err != nil {
+		return err
 	}
-	// 5. TODO: delete tarball
+	return os.Lchown(path, o.uid, o.gid)
 }
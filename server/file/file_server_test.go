@@ -0,0 +1,149 @@
+package file
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"cr/transfer"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"testing"
+)
+
+func TestSyncDir(t *testing.T) {
+	u, err := user.Current()
+	if err != nil {
+		t.Fatal(err)
+	}
+	root, err := filepath.EvalSymlinks(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	src := t.TempDir()
+	files := map[string][]byte{
+		"img/pages-1.img": make([]byte, 3<<20),
+		"img/core.img":    []byte("core"),
+		"dump.log":        []byte("log"),
+	}
+	for name, data := range files {
+		os.MkdirAll(filepath.Join(src, filepath.Dir(name)), 0o755)
+		if err := os.WriteFile(filepath.Join(src, name), data, 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink("img", filepath.Join(src, "current")); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	tracker := &testTracker{}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go handleConnection(conn, []string{root}, tracker)
+		}
+	}()
+	dst := filepath.Join(root, "ckpt")
+	sync := func() transfer.Progress {
+		t.Helper()
+		p, err := transfer.DialPool(context.Background(), l.Addr().String(), u.Username, "m1", nil, transfer.Codec{Name: transfer.CodecNone}, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer p.Close()
+		var last transfer.Progress
+		_, err = p.SyncDir(src, dst, func(pr transfer.Progress) { last = pr })
+		if err != nil {
+			t.Fatal(err)
+		}
+		return last
+	}
+
+	if pr := sync(); pr.Files != len(files) || pr.Skipped != 0 {
+		t.Errorf("first sync sent %d files and skipped %d, want %d and 0", pr.Files, pr.Skipped, len(files))
+	}
+	for name, data := range files {
+		b, err := os.ReadFile(filepath.Join(dst, name))
+		if err != nil || len(b) != len(data) {
+			t.Errorf("%s has %d bytes, %v, want %d", name, len(b), err, len(data))
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "current")); err != nil || link != "img" {
+		t.Errorf("symlink = %q, %v", link, err)
+	}
+	// only what changed is sent again, a file of the same size by digest
+	if err := os.WriteFile(filepath.Join(src, "img/core.img"), []byte("CORE"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if pr := sync(); pr.Files != 1 || pr.Skipped != len(files)-1 {
+		t.Errorf("second sync sent %d files and skipped %d, want 1 and %d", pr.Files, pr.Skipped, len(files)-1)
+	}
+	if b, _ := os.ReadFile(filepath.Join(dst, "img/core.img")); string(b) != "CORE" {
+		t.Errorf("changed file = %q", b)
+	}
+	committed := 0
+	for _, c := range tracker.calls {
+		if c.kind == "committed" && c.name == dst {
+			committed++
+		}
+	}
+	if committed != 2 {
+		t.Errorf("tracker saw %d commits of %s, want 2: %v", committed, dst, tracker.calls)
+	}
+}
+
+func TestReceiveOverSymlink(t *testing.T) {
+	parent := t.TempDir()
+	root := filepath.Join(parent, "root")
+	if err := os.MkdirAll(filepath.Join(root, "ckpt"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(parent, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	o := &owner{name: "test", uid: os.Getuid(), gid: os.Getgid(), roots: []string{root}}
+	// the owner leads entries out of the roots with symlinks of their own
+	for _, link := range []string{"t", "ckpt/t"} {
+		if err := os.Symlink(parent, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	tw.WriteHeader(&tar.Header{Name: "t", Typeflag: tar.TypeDir, Mode: 0o777})
+	tw.Close()
+	entries := []struct {
+		hdr  transfer.Header
+		body []byte
+	}{
+		{transfer.Header{Kind: transfer.KindDir, Name: root + "/t", Mode: 0o777}, nil},
+		{transfer.Header{Kind: transfer.KindFile, Name: root + "/t", Mode: 0o777}, nil},
+		{transfer.Header{Kind: transfer.KindTar, Name: root + "/ckpt", Mode: 0o755}, buf.Bytes()},
+	}
+	for _, e := range entries {
+		if err := receiveEntry(o, nil, &e.hdr, bytes.NewReader(e.body)); err == nil {
+			t.Errorf("%s entry %s passed", e.hdr.Kind, e.hdr.Name)
+		}
+	}
+	info, err := os.Stat(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o700 {
+		t.Errorf("mode of the parent of the root = %v", info.Mode().Perm())
+	}
+	// a symlink replaces a symlink
+	hdr := transfer.Header{Kind: transfer.KindSymlink, Name: root + "/t"}
+	if err := receiveEntry(o, nil, &hdr, bytes.NewReader([]byte("ckpt"))); err != nil {
+		t.Error(err)
+	}
+}
@@ -0,0 +1,137 @@
+package file
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sessionTTL is how long a session nobody uses is kept
+const sessionTTL = time.Hour
+
+// Tracker learns how the transfers of migrations go, so that the images of
+// a migration are only restored once complete
+type Tracker interface {
+	// TransferStarted is called when a session of migration starts
+	TransferStarted(migration, user, session string)
+	// TransferCommitted is called once the session confirmed the tree at
+	// name, as the sender named it, complete
+	TransferCommitted(migration, user, session, name string)
+	// TransferFailed is called when the tree at name turned out incomplete
+	TransferFailed(migration, user, session, name string, err error)
+}
+
+// session tracks the chunks the connections of a transfer landed
+type session struct {
+	key string
+	id  string
+	// migration is the migration the transfer belongs to, tracker is told
+	// how it goes if both are set
+	migration string
+	tracker   Tracker
+	mu        sync.Mutex
+	used      time.Time
+	// chunks maps the paths written in chunks to the size of every chunk
+	// at its offset
+	chunks map[string]map[int64]int64
+}
+
+var sessions = struct {
+	sync.Mutex
+	m map[string]*session
+}{m: make(map[string]*session)}
+
+func sessionKey(user, id string) string {
+	return user + "/" + id
+}
+
+// getSession returns the session id of user, it starts empty and belongs to
+// migration. Sessions idle for longer than sessionTTL are dropped.
+func getSession(user, id, migration string, tracker Tracker) *session {
+	sessions.Lock()
+	defer sessions.Unlock()
+	now := time.Now()
+	for key, s := range sessions.m {
+		s.mu.Lock()
+		idle := now.Sub(s.used)
+		s.mu.Unlock()
+		if idle > sessionTTL {
+			delete(sessions.m, key)
+		}
+	}
+	key := sessionKey(user, id)
+	s, ok := sessions.m[key]
+	if !ok {
+		s = &session{
+			key:       key,
+			id:        id,
+			migration: migration,
+			tracker:   tracker,
+			chunks:    make(map[string]map[int64]int64),
+		}
+		sessions.m[key] = s
+		if s.tracked() {
+			tracker.TransferStarted(migration, user, id)
+		}
+	}
+	s.mu.Lock()
+	s.used = now
+	s.mu.Unlock()
+	return s
+}
+
+// drop forgets the session
+func (s *session) drop() {
+	sessions.Lock()
+	defer sessions.Unlock()
+	delete(sessions.m, s.key)
+}
+
+// tracked tells whether the tracker follows the session
+func (s *session) tracked() bool {
+	return s.migration != "" && s.tracker != nil
+}
+
+// landed records a chunk written to path
+func (s *session) landed(path string, offset, size int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.used = time.Now()
+	if s.chunks[path] == nil {
+		s.chunks[path] = make(map[int64]int64)
+	}
+	s.chunks[path][offset] = size
+}
+
+// chunked tells whether path was written in chunks
+func (s *session) chunked(path string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.chunks[path] != nil
+}
+
+// complete checks the chunks landed cover path up to size without a gap
+func (s *session) complete(path string, size int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	chunks := s.chunks[path]
+	offsets := make([]int64, 0, len(chunks))
+	for off := range chunks {
+		offsets = append(offsets, off)
+	}
+	sort.Slice(offsets, func(i, j int) bool { return offsets[i] < offsets[j] })
+	var end int64
+	for _, off := range offsets {
+		if off > end {
+			return fmt.Errorf("%s misses %d bytes at %d", path, off-end, end)
+		}
+		if off+chunks[off] > end {
+			end = off + chunks[off]
+		}
+	}
+	if end < size {
+		return fmt.Errorf("%s misses %d bytes at %d", path, size-end, end)
+	}
+	return nil
+}
@@ -0,0 +1,74 @@
+package file
+
+import "testing"
+
+func TestSessionComplete(t *testing.T) {
+	tests := []struct {
+		name string
+		// chunks are offset and size pairs
+		chunks [][2]int64
+		size   int64
+		ok     bool
+	}{
+		{"empty file", nil, 0, true},
+		{"nothing landed", nil, 10, false},
+		{"one chunk", [][2]int64{{0, 10}}, 10, true},
+		{"in order", [][2]int64{{0, 4}, {4, 4}, {8, 2}}, 10, true},
+		{"out of order", [][2]int64{{8, 2}, {0, 4}, {4, 4}}, 10, true},
+		{"overlapping", [][2]int64{{0, 6}, {4, 6}}, 10, true},
+		{"gap", [][2]int64{{0, 4}, {5, 5}}, 10, false},
+		{"missing start", [][2]int64{{2, 8}}, 10, false},
+		{"short", [][2]int64{{0, 4}, {4, 4}}, 10, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := &session{chunks: make(map[string]map[int64]int64)}
+			for _, c := range tt.chunks {
+				s.landed("/f", c[0], c[1])
+			}
+			err := s.complete("/f", tt.size)
+			if (err == nil) != tt.ok {
+				t.Errorf("complete = %v, want ok %v", err, tt.ok)
+			}
+		})
+	}
+}
+
+type trackerCall struct {
+	kind, migration, user, session, name string
+}
+
+type testTracker struct {
+	calls []trackerCall
+}
+
+func (t *testTracker) TransferStarted(migration, user, session string) {
+	t.calls = append(t.calls, trackerCall{"started", migration, user, session, ""})
+}
+
+func (t *testTracker) TransferCommitted(migration, user, session, name string) {
+	t.calls = append(t.calls, trackerCall{"committed", migration, user, session, name})
+}
+
+func (t *testTracker) TransferFailed(migration, user, session, name string, err error) {
+	t.calls = append(t.calls, trackerCall{"failed", migration, user, session, name})
+}
+
+func TestGetSession(t *testing.T) {
+	tracker := &testTracker{}
+	a := getSession("alice", "s1", "m1", tracker)
+	defer a.drop()
+	if again := getSession("alice", "s1", "m1", tracker); again != a {
+		t.Errorf("the connections of a session don't share it")
+	}
+	b := getSession("bob", "s1", "", tracker)
+	defer b.drop()
+	if b == a {
+		t.Errorf("sessions of different users are shared")
+	}
+	// only sessions of a migration are tracked, once
+	want := []trackerCall{{"started", "m1", "alice", "s1", ""}}
+	if len(tracker.calls) != len(want) || tracker.calls[0] != want[0] {
+		t.Errorf("tracker calls = %v, want %v", tracker.calls, want)
+	}
+}
@@ -1,25 +1,128 @@
 package main
 
 import (
+	"cr/apptainer"
 	"cr/migrator"
 	"cr/server/file"
 	"cr/server/rpc"
+	"cr/transfer"
+	"cr/util"
+	"flag"
 	"log"
+	"strings"
 	"sync"
 )
 
+var (
+	noSharedFS  = flag.Bool("no-shared-fs", false, "no shared filesystem between nodes, sync checkpoints to the target")
+	codec       = flag.String("codec", transfer.CodecAuto, "default codec of transfers as name[:level], one of none, gzip, zstd, lz4 and auto")
+	streams     = flag.Int("streams", migrator.DefaultStreams, "connections every transfer is spread over")
+	bwlimit     = flag.String("bwlimit", "", "bytes per second all migrations from this node send together, with a K, M or G suffix, split fairly among them, empty for no cap")
+	mgBwlimit   = flag.String("migration-bwlimit", "", "bytes per second every migration sends at most unless it asks for another cap, empty for no cap")
+	syncMode    = flag.String("sync", migrator.SyncNative, "how checkpoints are synced without a shared filesystem, native or rsync")
+	journalPath = flag.String("journal", "/var/lib/migrator/journal", "path of the migration journal")
+	socketPath  = flag.String("socket", migrator.SocketPath, "unix socket local clients connect to")
+	logDir      = flag.String("log-dir", "/var/lib/migrator/logs", "directory of the command logs of every migration, empty turns them off")
+	tlsCert     = flag.String("tls-cert", "", "certificate of this node, turns on mutual TLS between servers")
+	tlsKey      = flag.String("tls-key", "", "key of the certificate of this node")
+	tlsCA       = flag.String("tls-ca", "", "cluster CA the certificates of the peers must be signed by")
+	tlsPins     = flag.String("tls-pin", "", "comma separated SHA-256 fingerprints of the only peer certificates accepted")
+	allowPeers  = flag.String("allow-peers", "", "comma separated addresses and CIDR networks peers may connect from, required without TLS unless --insecure")
+	insecure    = flag.Bool("insecure", false, "serve peers from anywhere without TLS, they are trusted with any user")
+	ckptRoots   = flag.String("checkpoint-roots", "~/.apptainer/checkpoint,"+apptainer.TmpfsDir, "comma separated dirs peers may write checkpoints under, ~ is the home of the checkpoint owner")
+	maxOutbound = flag.Int("max-outbound", migrator.DefaultMaxOutbound, "max migrations running from this node, further ones queue")
+	maxInbound  = flag.Int("max-inbound", migrator.DefaultMaxInbound, "max migrations running to this node, further ones queue")
+
+	dumpTimeout       = flag.Duration("dump-timeout", migrator.DefaultDumpTimeout, "deadline of every dump and pre-dump")
+	stopTimeout       = flag.Duration("stop-timeout", migrator.DefaultStopTimeout, "deadline of stopping an instance")
+	transferTimeout   = flag.Duration("transfer-timeout", migrator.DefaultTransferTimeout, "deadline of every checkpoint transfer")
+	connectTimeout    = flag.Duration("connect-timeout", migrator.DefaultConnectTimeout, "deadline of connecting to and querying a peer")
+	pageServerTimeout = flag.Duration("page-server-timeout", migrator.DefaultPageServerTimeout, "deadline of launching a page server")
+	restoreTimeout    = flag.Duration("restore-timeout", migrator.DefaultRestoreTimeout, "deadline of restoring an instance")
+)
+
 func init() {
 	log.SetFlags(log.Lshortfile | log.Ldate | log.Ltime | log.Lmicroseconds)
 }
 
 func main() {
+	flag.Parse()
+
+	m := &migrator.Migrator{
+		IsSharedFS:  !*noSharedFS,
+		MaxOutbound: *maxOutbound,
+		MaxInbound:  *maxInbound,
+		LogDir:      *logDir,
+		Sync:        *syncMode,
+		Streams:     *streams,
+		Timeouts: migrator.Timeouts{
+			Dump:       *dumpTimeout,
+			Stop:       *stopTimeout,
+			Transfer:   *transferTimeout,
+			Connect:    *connectTimeout,
+			PageServer: *pageServerTimeout,
+			Restore:    *restoreTimeout,
+		},
+	}
+	defaultCodec, err := transfer.ParseCodec(*codec)
+	if err != nil {
+		log.Fatalf("bad --codec: %v", err)
+	}
+	m.Codec = defaultCodec
+	m.BwLimit, err = transfer.ParseRate(*bwlimit)
+	if err != nil {
+		log.Fatalf("bad --bwlimit: %v", err)
+	}
+	m.MigrationBwLimit, err = transfer.ParseRate(*mgBwlimit)
+	if err != nil {
+		log.Fatalf("bad --migration-bwlimit: %v", err)
+	}
+	if m.Sync != migrator.SyncNative && m.Sync != migrator.SyncRsync {
+		log.Fatalf("unknown sync %q, want %s or %s", m.Sync, migrator.SyncNative, migrator.SyncRsync)
+	}
+	if *tlsCert != "" {
+		var pins []string
+		if *tlsPins != "" {
+			pins = strings.Split(*tlsPins, ",")
+		}
+		config, err := util.TLSConfig(*tlsCert, *tlsKey, *tlsCA, pins)
+		if err != nil {
+			log.Fatalf("failed to set up TLS: %v", err)
+		}
+		m.TLS = config
+	}
+	m.Peers, err = util.ParsePeers(*allowPeers)
+	if err != nil {
+		log.Fatalf("bad --allow-peers: %v", err)
+	}
+	if m.TLS == nil && m.Peers == nil {
+		if !*insecure {
+			log.Fatalf("refuse to serve peers unauthenticated, set up TLS with --tls-cert or pass --allow-peers or --insecure")
+		}
+		log.Printf("no TLS configured, peers from anywhere are trusted with any user")
+	}
+	journal, err := migrator.OpenJournal(*journalPath)
+	if err != nil {
+		log.Fatalf("failed to open journal %s: %v", *journalPath, err)
+	}
+	defer journal.Close()
+	m.Journal = journal
+	// resolve the migrations a previous run left behind
+	err = m.Recover()
+	if err != nil {
+		log.Printf("failed to recover unfinished migrations: %v", err)
+	}
+
 	var wg sync.WaitGroup
-	wg.Add(2)
-	// launch a rpc server
-	go rpc.LaunchServer(migrator.RPCPort, &wg)
+	wg.Add(3)
+	// launch a rpc server for local clients
+	go rpc.LaunchLocalServer(*socketPath, m, &wg)
+	log.Printf("local rpc server launched on %s", *socketPath)
+	// launch a rpc server for peers
+	go rpc.LaunchServer(migrator.RPCPort, m, &wg)
 	log.Printf("rpc server launched on port %s", migrator.RPCPort)
 	// launch a file receive server
-	go file.LaunchFileReceiveServer(migrator.FilePort, &wg)
+	go file.LaunchFileReceiveServer(migrator.FilePort, strings.Split(*ckptRoots, ","), m.TLS, m.Peers, m, &wg)
 	log.Printf("file receive server launched on port %s", migrator.FilePort)
 
 	wg.Wait()
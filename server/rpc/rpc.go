@@ -2,31 +2,107 @@ package rpc
 
 import (
 	"cr/migrator"
+	"crypto/tls"
+	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"net/rpc"
 	"os"
 	"sync"
+	"syscall"
 )
 
-func LaunchServer(port string, wg *sync.WaitGroup) {
+// LaunchServer serves the steps peers run on this node over net/rpc on port,
+// with mutual TLS if m.TLS is set and to m.Peers only if that is set
+func LaunchServer(port string, m *migrator.Migrator, wg *sync.WaitGroup) {
+	defer wg.Done()
 	// launch a rpc server, serves on port 1234
-	m := new(migrator.Migrator)
-	// TODO: use cmd line package to parse args
-	if len(os.Args) >= 2 && os.Args[1] == "--no-shared-fs" {
-		m.IsSharedFS = false
-	} else {
-		m.IsSharedFS = true
-	}
-	err := rpc.Register(m)
+	server := rpc.NewServer()
+	err := server.RegisterName("Migrator", m.Peer())
 	if err != nil {
 		log.Fatal("Register error: ", err)
 	}
-	rpc.HandleHTTP()
+	server.HandleHTTP(rpc.DefaultRPCPath, rpc.DefaultDebugPath)
+
+	listener, err := net.Listen("tcp", port)
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	listener = m.Peers.Listener(listener)
+	if m.TLS != nil {
+		listener = tls.NewListener(listener, m.TLS)
+	}
+	err = http.Serve(listener, nil)
+	if err != nil {
+		log.Fatal("Serve: ", err)
+	}
+}
+
+// LaunchLocalServer serves local clients over net/rpc on the unix socket at
+// path. Every connection runs as the user on the other end of it.
+func LaunchLocalServer(path string, m *migrator.Migrator, wg *sync.WaitGroup) {
+	defer wg.Done()
+	// a socket left behind by a previous run
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		log.Fatal("Listen: ", err)
+	}
+	// any user may connect, the peer credentials tell them apart
+	err = os.Chmod(path, 0666)
+	if err != nil {
+		log.Fatal("Chmod: ", err)
+	}
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			log.Fatal("Accept: ", err)
+		}
+		go serveLocal(conn.(*net.UnixConn), m)
+	}
+}
 
-	err = http.ListenAndServe(port, nil)
+// serveLocal serves a local client with the service of its user
+func serveLocal(conn *net.UnixConn, m *migrator.Migrator) {
+	uid, err := peerUID(conn)
+	if err != nil {
+		log.Printf("failed to get credentials of local client: %v", err)
+		conn.Close()
+		return
+	}
+	local, err := m.Local(uid)
 	if err != nil {
-		log.Fatal("ListenAndServe: ", err)
+		log.Printf("refuse local client: %v", err)
+		conn.Close()
+		return
+	}
+	server := rpc.NewServer()
+	err = server.RegisterName("Migrator", local)
+	if err != nil {
+		log.Printf("Register error: %v", err)
+		conn.Close()
+		return
+	}
+	server.ServeConn(conn)
+}
+
+// peerUID returns the uid of the process on the other end of conn
+func peerUID(conn *net.UnixConn) (uint32, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, err
+	}
+	if credErr != nil {
+		return 0, fmt.Errorf("SO_PEERCRED: %v", credErr)
 	}
-	wg.Done()
+	return cred.Uid, nil
 }
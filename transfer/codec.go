@@ -0,0 +1,221 @@
+package transfer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"sync"
+)
+
+const (
+	// CodecNone sends the content as is
+	CodecNone = "none"
+	// CodecGzip compresses in process
+	CodecGzip = "gzip"
+	// CodecZstd and CodecLz4 run the zstd and lz4 commands, they're only
+	// offered where the command is installed
+	CodecZstd = "zstd"
+	CodecLz4  = "lz4"
+	// CodecAuto picks the codec which moves a sample of the content fastest
+	// over the connection, see Sender.probe
+	CodecAuto = "auto"
+)
+
+// Codec compresses the content of entries
+type Codec struct {
+	Name string
+	// Level is the compression level, the default of the codec if zero
+	Level int
+}
+
+func (c Codec) String() string {
+	if c.Level == 0 {
+		return c.Name
+	}
+	return fmt.Sprintf("%s:%d", c.Name, c.Level)
+}
+
+// ParseCodec parses a codec as "name" or "name:level"
+func ParseCodec(s string) (Codec, error) {
+	c := Codec{Name: s}
+	for i := 0; i < len(s); i++ {
+		if s[i] == ':' {
+			level, err := strconv.Atoi(s[i+1:])
+			if err != nil {
+				return c, fmt.Errorf("bad level in codec %q", s)
+			}
+			c = Codec{Name: s[:i], Level: level}
+			break
+		}
+	}
+	if c.Name == "" {
+		c.Name = CodecAuto
+	}
+	return c, c.Validate()
+}
+
+// levels are the levels the codecs take besides 0, none and auto take none
+var levels = map[string][2]int{
+	CodecGzip: {gzip.HuffmanOnly, gzip.BestCompression},
+	CodecZstd: {1, 19},
+	CodecLz4:  {1, 12},
+}
+
+// Validate checks that the codec is known and takes its level
+func (c Codec) Validate() error {
+	switch c.Name {
+	case CodecNone, CodecGzip, CodecZstd, CodecLz4, CodecAuto:
+	default:
+		return fmt.Errorf("unknown codec %q", c.Name)
+	}
+	if c.Level == 0 {
+		return nil
+	}
+	r, ok := levels[c.Name]
+	if !ok {
+		return fmt.Errorf("codec %s takes no level", c.Name)
+	}
+	if c.Level < r[0] || c.Level > r[1] {
+		return fmt.Errorf("level %d of codec %s isn't within %d..%d", c.Level, c.Name, r[0], r[1])
+	}
+	return nil
+}
+
+var (
+	codecsOnce sync.Once
+	codecs     []string
+)
+
+// Codecs returns the codecs this node can use
+func Codecs() []string {
+	codecsOnce.Do(func() {
+		codecs = []string{CodecNone, CodecGzip}
+		for _, name := range []string{CodecZstd, CodecLz4} {
+			if _, err := exec.LookPath(name); err == nil {
+				codecs = append(codecs, name)
+			}
+		}
+	})
+	return codecs
+}
+
+func hasCodec(codecs []string, name string) bool {
+	for _, c := range codecs {
+		if c == name {
+			return true
+		}
+	}
+	return false
+}
+
+// compress returns a reader of the content of r compressed with c. close
+// releases what the codec holds and must be called once done.
+func compress(c Codec, r io.Reader) (io.Reader, func(), error) {
+	switch c.Name {
+	case "", CodecNone:
+		return r, func() {}, nil
+	case CodecGzip:
+		level := c.Level
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		pr, pw := io.Pipe()
+		zw, err := gzip.NewWriterLevel(pw, level)
+		if err != nil {
+			return nil, nil, err
+		}
+		go func() {
+			_, err := io.Copy(zw, r)
+			if err == nil {
+				err = zw.Close()
+			}
+			pw.CloseWithError(err)
+		}()
+		return pr, func() { pr.CloseWithError(io.ErrClosedPipe) }, nil
+	case CodecZstd, CodecLz4:
+		args := []string{"-c", "-q"}
+		if c.Level != 0 {
+			args = append(args, fmt.Sprintf("-%d", c.Level))
+		}
+		return filter(r, c.Name, args...)
+	}
+	return nil, nil, fmt.Errorf("unknown codec %q", c.Name)
+}
+
+// decompress returns a reader of the content compressed with codec read
+// from r. close releases what the codec holds and must be called once done.
+func decompress(codec string, r io.Reader) (io.Reader, func(), error) {
+	switch codec {
+	case "", CodecNone:
+		return r, func() {}, nil
+	case CodecGzip:
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, err
+		}
+		zr.Multistream(false)
+		return zr, func() { zr.Close() }, nil
+	case CodecZstd, CodecLz4:
+		if !hasCodec(Codecs(), codec) {
+			return nil, nil, fmt.Errorf("codec %s isn't installed", codec)
+		}
+		return filter(r, codec, "-d", "-c", "-q")
+	}
+	return nil, nil, fmt.Errorf("unknown codec %q", codec)
+}
+
+// filter runs the command with r as its input and returns a reader of its
+// output, which fails if the command does
+func filter(r io.Reader, name string, args ...string) (io.Reader, func(), error) {
+	cmd := exec.Command(name, args...)
+	cmd.Stdin = r
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return nil, nil, err
+	}
+	f := &filterReader{out: out, cmd: cmd, stderr: &stderr}
+	return f, f.close, nil
+}
+
+type filterReader struct {
+	out    io.Reader
+	cmd    *exec.Cmd
+	stderr *bytes.Buffer
+	once   sync.Once
+	err    error
+}
+
+func (f *filterReader) Read(p []byte) (int, error) {
+	n, err := f.out.Read(p)
+	if err == io.EOF {
+		f.wait()
+		if f.err != nil {
+			return n, f.err
+		}
+	}
+	return n, err
+}
+
+func (f *filterReader) wait() {
+	f.once.Do(func() {
+		err := f.cmd.Wait()
+		if err != nil {
+			f.err = fmt.Errorf("%s: %v: %s", f.cmd.Path, err, bytes.TrimSpace(f.stderr.Bytes()))
+		}
+	})
+}
+
+// close kills the command unless it's done
+func (f *filterReader) close() {
+	f.cmd.Process.Kill()
+	f.wait()
+}
@@ -0,0 +1,40 @@
+package transfer
+
+import "testing"
+
+func TestParseCodec(t *testing.T) {
+	tests := []struct {
+		in   string
+		want Codec
+		ok   bool
+	}{
+		{"", Codec{Name: CodecAuto}, true},
+		{"auto", Codec{Name: CodecAuto}, true},
+		{"none", Codec{Name: CodecNone}, true},
+		{"gzip", Codec{Name: CodecGzip}, true},
+		{"gzip:9", Codec{Name: CodecGzip, Level: 9}, true},
+		{"gzip:-2", Codec{Name: CodecGzip, Level: -2}, true},
+		{"gzip:10", Codec{}, false},
+		{"gzip:-3", Codec{}, false},
+		{"zstd:19", Codec{Name: CodecZstd, Level: 19}, true},
+		{"zstd:20", Codec{}, false},
+		{"zstd:-1", Codec{}, false},
+		{"lz4:12", Codec{Name: CodecLz4, Level: 12}, true},
+		{"lz4:13", Codec{}, false},
+		{"none:1", Codec{}, false},
+		{"auto:3", Codec{}, false},
+		{"zstd:", Codec{}, false},
+		{"zstd:x", Codec{}, false},
+		{"brotli", Codec{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseCodec(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseCodec(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("ParseCodec(%q) = %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,236 @@
+// Package transfer implements the protocol the migrator servers ship
+// checkpoint files with.
+//
+// A connection starts with a handshake: the sender sends a hello carrying
+// the protocol version, the receiver answers with a welcome or an error.
+// Then the sender sends entries, each one a header frame describing the
+// file, its content in data frames and an end frame carrying the size and
+// the digest of the content. An entry is a file, a directory streamed as a
+// tarball, or a single directory or symlink of a tree being synced. The
+// content of files and tarballs is compressed with a codec both sides have,
+// the welcome tells which the receiver has. The receiver answers every entry
+// with an ack once it landed, or with an error. A list entry asks for the
+// members of a tree instead, the receiver answers it with a manifest, the
+// sender then only sends what differs. A digest entry asks for the digest
+// of files the size can't tell apart, answered with a manifest as well. A
+// probe entry is dropped by the receiver, it only times the connection.
+//
+// A transfer may be spread over several connections of the same session:
+// large files are sent in chunks written in place, small files batched in
+// tarballs. A commit entry lists the files of the tree, the receiver only
+// acks it once every one of them is complete.
+package transfer
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version is the version of the protocol
+const Version = 7
+
+const (
+	magic = "CRFT"
+	// chunkSize is the size of the data frames sent
+	chunkSize = 256 << 10
+	// maxFrame bounds the frames accepted
+	maxFrame = 4 << 20
+)
+
+type frameType byte
+
+const (
+	frameHello frameType = iota + 1
+	frameWelcome
+	frameHeader
+	frameData
+	frameEnd
+	frameAck
+	frameError
+	frameManifest
+)
+
+func (t frameType) String() string {
+	switch t {
+	case frameHello:
+		return "hello"
+	case frameWelcome:
+		return "welcome"
+	case frameHeader:
+		return "header"
+	case frameData:
+		return "data"
+	case frameEnd:
+		return "end"
+	case frameAck:
+		return "ack"
+	case frameError:
+		return "error"
+	case frameManifest:
+		return "manifest"
+	}
+	return fmt.Sprintf("frame(%d)", byte(t))
+}
+
+type hello struct {
+	Magic   string
+	Version int
+	// User owns the files sent over the connection
+	User string
+	// Session groups the connections of a transfer, see Pool
+	Session string
+	// Migration is the migration the session belongs to, if any
+	Migration string
+}
+
+type welcome struct {
+	Version int
+	// Codecs are the codecs the receiver can decompress
+	Codecs []string
+}
+
+const (
+	// KindFile is a regular file
+	KindFile = "file"
+	// KindTar is a directory packed into a tarball on the fly, the
+	// receiver unpacks it into Name
+	KindTar = "tar"
+	// KindDir is a directory, without content
+	KindDir = "dir"
+	// KindSymlink is a symlink, the content is its target
+	KindSymlink = "symlink"
+	// KindList asks for the members of the tree at Name, without content
+	// and without the digests of the files
+	KindList = "list"
+	// KindDigest asks for the digest of the file at Name, without content
+	KindDigest = "digest"
+	// KindProbe is dropped by the receiver once acked
+	KindProbe = "probe"
+	// KindChunk is the part of the file Name starting at Offset, the
+	// receiver writes it in place
+	KindChunk = "chunk"
+	// KindCommit closes the session of the connection, its content lists
+	// every file of the tree at Name as JSON. The receiver acks it once
+	// every chunk of them landed.
+	KindCommit = "commit"
+)
+
+// Header describes an entry
+type Header struct {
+	Kind string
+	// Name is where the receiver puts the file
+	Name string
+	// Size is -1 if it's only known once the content is sent
+	Size int64
+	// Offset is where a chunk goes in its file
+	Offset int64
+	Mode   uint32
+	UID    int
+	GID    int
+	// ModTime is kept by the receiver if it isn't zero
+	ModTime time.Time
+	// Digest is the sha256 of the content, hex encoded, empty if it's only
+	// known once the content is sent
+	Digest string
+	// Codec compressed the content in the data frames, none if empty
+	Codec string
+}
+
+// end closes the content of an entry. Size and Digest are those of the
+// content, Wire counts the bytes of the data frames.
+type end struct {
+	Size   int64
+	Digest string
+	Wire   int64
+}
+
+type ack struct {
+	Name string
+	Size int64
+}
+
+type errorFrame struct {
+	Message string
+}
+
+// RemoteError is an error the receiver sent back
+type RemoteError struct {
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return "receiver: " + e.Message
+}
+
+// frame layout: 1 byte type, 4 bytes big endian length, payload
+func writeFrame(w *bufio.Writer, t frameType, payload []byte) error {
+	var hdr [5]byte
+	hdr[0] = byte(t)
+	binary.BigEndian.PutUint32(hdr[1:], uint32(len(payload)))
+	_, err := w.Write(hdr[:])
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(payload)
+	return err
+}
+
+func writeJSON(w *bufio.Writer, t frameType, v interface{}) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	err = writeFrame(w, t, payload)
+	if err != nil {
+		return err
+	}
+	return w.Flush()
+}
+
+// readFrame reads the next frame, buf is reused for the payload if it's big
+// enough
+func readFrame(r *bufio.Reader, buf []byte) (frameType, []byte, error) {
+	var hdr [5]byte
+	_, err := io.ReadFull(r, hdr[:])
+	if err != nil {
+		return 0, nil, err
+	}
+	n := binary.BigEndian.Uint32(hdr[1:])
+	if n > maxFrame {
+		return 0, nil, fmt.Errorf("frame of %d bytes exceeds %d", n, maxFrame)
+	}
+	if cap(buf) < int(n) {
+		buf = make([]byte, n)
+	}
+	buf = buf[:n]
+	_, err = io.ReadFull(r, buf)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return frameType(hdr[0]), buf, err
+}
+
+// readReply reads a control frame of type want into v, an error frame is
+// returned as a RemoteError
+func readReply(r *bufio.Reader, want frameType, v interface{}) error {
+	t, payload, err := readFrame(r, nil)
+	if err != nil {
+		return err
+	}
+	switch t {
+	case want:
+		return json.Unmarshal(payload, v)
+	case frameError:
+		e := errorFrame{}
+		err = json.Unmarshal(payload, &e)
+		if err != nil {
+			return err
+		}
+		return &RemoteError{Message: e.Message}
+	}
+	return fmt.Errorf("unexpected %v frame, want %v", t, want)
+}
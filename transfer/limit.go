@@ -0,0 +1,210 @@
+package transfer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limiter caps the bandwidth of the transfers of a node. The transfers
+// holding a share of it split the cap fairly: a transfer capped below an
+// even split keeps its own cap and leaves the rest to the others.
+type Limiter struct {
+	mu sync.Mutex
+	// rate is the cap in bytes per second, 0 for none
+	rate   int64
+	shares map[*Share]bool
+}
+
+// NewLimiter returns a limiter capping transfers at rate bytes per second
+// together, 0 for no cap
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{rate: rate, shares: make(map[*Share]bool)}
+}
+
+// Share is the part of a limiter one transfer holds, all its connections
+// write through it
+type Share struct {
+	l *Limiter
+	// max caps the transfer on its own, 0 for none
+	max int64
+
+	mu   sync.Mutex
+	rate int64
+	// next is when the bytes written so far are paid for
+	next time.Time
+}
+
+// Share joins a transfer capped at max bytes per second on its own, 0 for
+// no own cap, at least minRate. Release must be called once the transfer
+// is over. A nil limiter only applies max.
+func (l *Limiter) Share(max int64) *Share {
+	if max > 0 && max < minRate {
+		max = minRate
+	}
+	s := &Share{l: l, max: max, rate: max}
+	if l == nil {
+		return s
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.shares[s] = true
+	l.balance()
+	return s
+}
+
+// Release gives the share of the transfer back to the others
+func (s *Share) Release() {
+	if s.l == nil {
+		return
+	}
+	s.l.mu.Lock()
+	defer s.l.mu.Unlock()
+	delete(s.l.shares, s)
+	s.l.balance()
+}
+
+// balance splits the rate of the limiter among the shares, the smallest
+// own caps first so what they leave goes to the others. No share gets less
+// than minRate, so too many transfers together exceed the rate.
+func (l *Limiter) balance() {
+	shares := make([]*Share, 0, len(l.shares))
+	for s := range l.shares {
+		shares = append(shares, s)
+	}
+	sort.Slice(shares, func(i, j int) bool {
+		a, b := shares[i].max, shares[j].max
+		return a != 0 && (b == 0 || a < b)
+	})
+	left := l.rate
+	for i, s := range shares {
+		rate := s.max
+		if l.rate > 0 {
+			fair := left / int64(len(shares)-i)
+			if fair < minRate {
+				fair = minRate
+			}
+			if rate == 0 || rate > fair {
+				rate = fair
+			}
+			left -= rate
+		}
+		s.mu.Lock()
+		s.rate = rate
+		s.mu.Unlock()
+	}
+}
+
+// Rate returns the bytes per second the transfer may send right now, 0 for
+// no cap
+func (s *Share) Rate() int64 {
+	if s == nil {
+		return 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rate
+}
+
+// wait blocks until n more bytes fit in the rate of the share
+func (s *Share) wait(n int) {
+	s.mu.Lock()
+	if s.rate <= 0 {
+		s.mu.Unlock()
+		return
+	}
+	now := time.Now()
+	if s.next.Before(now) {
+		// no credit for the time the transfer was idle
+		s.next = now
+	}
+	s.next = s.next.Add(time.Duration(float64(n) * float64(time.Second) / float64(s.rate)))
+	d := s.next.Sub(now)
+	s.mu.Unlock()
+	time.Sleep(d)
+}
+
+// Writer returns a writer to w which keeps to the rate of the share
+func (s *Share) Writer(w io.Writer) io.Writer {
+	if s == nil {
+		return w
+	}
+	return &limitedWriter{w: w, s: s}
+}
+
+type limitedWriter struct {
+	w io.Writer
+	s *Share
+}
+
+const (
+	// limitBlock bounds what is written at once so a slow rate doesn't
+	// sleep for long before a large write
+	limitBlock = 64 << 10
+	// minRate is the least a transfer may send, a block per second, it
+	// keeps the sleeps before a block well within the stall timeout
+	minRate = limitBlock
+)
+
+func (lw *limitedWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		b := p
+		if len(b) > limitBlock {
+			b = b[:limitBlock]
+		}
+		lw.s.wait(len(b))
+		n, err := lw.w.Write(b)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// ParseRate parses a rate in bytes per second, with an optional K, M or G
+// suffix for powers of 1024. Empty and "0" mean no cap.
+func ParseRate(s string) (int64, error) {
+	num := strings.TrimSpace(s)
+	if num == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	switch strings.ToUpper(num[len(num)-1:]) {
+	case "K":
+		mult = 1 << 10
+	case "M":
+		mult = 1 << 20
+	case "G":
+		mult = 1 << 30
+	}
+	if mult > 1 {
+		num = num[:len(num)-1]
+	}
+	n, err := strconv.ParseFloat(num, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("bad rate %q", s)
+	}
+	return int64(n * float64(mult)), nil
+}
+
+// FormatRate formats a rate in bytes per second for people to read
+func FormatRate(rate int64) string {
+	switch {
+	case rate <= 0:
+		return "unlimited"
+	case rate%(1<<30) == 0:
+		return fmt.Sprintf("%dG", rate>>30)
+	case rate%(1<<20) == 0:
+		return fmt.Sprintf("%dM", rate>>20)
+	case rate%(1<<10) == 0:
+		return fmt.Sprintf("%dK", rate>>10)
+	}
+	return strconv.FormatInt(rate, 10)
+}
@@ -0,0 +1,100 @@
+package transfer
+
+import "testing"
+
+func TestParseRate(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"", 0, true},
+		{"0", 0, true},
+		{"1000", 1000, true},
+		{"64K", 64 << 10, true},
+		{"64k", 64 << 10, true},
+		{"1.5M", 3 << 19, true},
+		{" 2G ", 2 << 30, true},
+		{"-1M", 0, false},
+		{"M", 0, false},
+		{"10X", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseRate(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("ParseRate(%q) error = %v, want ok %v", tt.in, err, tt.ok)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("ParseRate(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestFormatRate(t *testing.T) {
+	for _, rate := range []int64{64 << 10, 3 << 20, 2 << 30, 1000} {
+		got, err := ParseRate(FormatRate(rate))
+		if err != nil || got != rate {
+			t.Errorf("ParseRate(FormatRate(%d)) = %d, %v", rate, got, err)
+		}
+	}
+	if got := FormatRate(0); got != "unlimited" {
+		t.Errorf("FormatRate(0) = %q", got)
+	}
+}
+
+func TestBalance(t *testing.T) {
+	const M = 1 << 20
+	tests := []struct {
+		name string
+		rate int64
+		// max are the own caps of the shares, want what they get
+		max  []int64
+		want []int64
+	}{
+		{"no cap", 0, []int64{0, 5 * M}, []int64{0, 5 * M}},
+		{"even", 90 * M, []int64{0, 0, 0}, []int64{30 * M, 30 * M, 30 * M}},
+		{"own cap under share", 90 * M, []int64{10 * M, 0, 0}, []int64{10 * M, 40 * M, 40 * M}},
+		{"own caps over share", 90 * M, []int64{50 * M, 60 * M}, []int64{45 * M, 45 * M}},
+		{"mixed", 100 * M, []int64{70 * M, 10 * M, 0}, []int64{45 * M, 10 * M, 45 * M}},
+		{"tiny own cap", 0, []int64{1}, []int64{minRate}},
+		{"floor", 100 << 10, []int64{0, 0, 0, 0}, []int64{minRate, minRate, minRate, minRate}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := NewLimiter(tt.rate)
+			shares := make([]*Share, len(tt.max))
+			for i, max := range tt.max {
+				shares[i] = l.Share(max)
+			}
+			for i, s := range shares {
+				if got := s.Rate(); got != tt.want[i] {
+					t.Errorf("share %d rate = %d, want %d", i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestRelease(t *testing.T) {
+	l := NewLimiter(90 << 20)
+	a, b, c := l.Share(0), l.Share(0), l.Share(0)
+	a.Release()
+	// what a share leaves goes to the others
+	if b.Rate() != 45<<20 || c.Rate() != 45<<20 {
+		t.Errorf("rates after release = %d, %d, want %d", b.Rate(), c.Rate(), 45<<20)
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	s := l.Share(3 << 20)
+	if got := s.Rate(); got != 3<<20 {
+		t.Errorf("rate = %d, want own cap", got)
+	}
+	s.Release()
+	var none *Share
+	if none.Rate() != 0 {
+		t.Errorf("nil share has a rate")
+	}
+}
@@ -0,0 +1,512 @@
+package transfer
+
+import (
+	"context"
+	"cr/util"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	// partSize is the size of the chunks large files are sent in
+	partSize = 64 << 20
+	// smallFile is the size under which files are batched
+	smallFile = 1 << 20
+	// batchSize bounds the content of a batch
+	batchSize = 16 << 20
+
+	// resumeAttempts bounds how many times a dropped stream is dialed again
+	// for one entry, resumeBackoff is the wait before the first attempt,
+	// doubled after every failed one up to maxBackoff
+	resumeAttempts = 6
+	resumeBackoff  = 500 * time.Millisecond
+	maxBackoff     = 10 * time.Second
+)
+
+// Pool spreads a transfer over several connections to the same receiver,
+// all in one session. The receiver keeps what it confirmed of the session
+// when a connection drops, so the pool dials it again and only sends the
+// entry which was in flight once more.
+type Pool struct {
+	senders []*Sender
+	session Session
+	// ctx, addr, user and config dial the streams again
+	ctx    context.Context
+	addr   string
+	user   string
+	config *tls.Config
+	share  *Share
+}
+
+// DialPool opens streams connections to the receiver at addr like Dial, in
+// a new session of migration
+func DialPool(ctx context.Context, addr, user, migration string, config *tls.Config, codec Codec, streams int) (*Pool, error) {
+	if streams < 1 {
+		streams = 1
+	}
+	p := &Pool{
+		session: Session{ID: util.NewID(), Migration: migration},
+		ctx:     ctx,
+		addr:    addr,
+		user:    user,
+		config:  config,
+	}
+	for i := 0; i < streams; i++ {
+		s, err := Dial(ctx, addr, user, config, codec, p.session)
+		if err != nil {
+			p.Close()
+			return nil, err
+		}
+		p.senders = append(p.senders, s)
+	}
+	return p, nil
+}
+
+func (p *Pool) Close() error {
+	for _, s := range p.senders {
+		s.Close()
+	}
+	return nil
+}
+
+// Limit makes the connections of the pool keep to the rate of share
+// together
+func (p *Pool) Limit(share *Share) {
+	p.share = share
+	for _, s := range p.senders {
+		s.limit(share)
+	}
+}
+
+// do runs f with the i-th stream. If the connection drops, the stream is
+// dialed again into the session after a backoff and f runs once more.
+func (p *Pool) do(i int, f func(s *Sender) error) error {
+	err := f(p.senders[i])
+	backoff := resumeBackoff
+	for attempt := 1; attempt <= resumeAttempts && dropped(err) && p.ctx.Err() == nil; attempt++ {
+		log.Printf("stream %d to %s dropped: %v, resuming in %v", i, p.addr, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-p.ctx.Done():
+			return err
+		}
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+		err = p.redial(i)
+		if err == nil {
+			err = f(p.senders[i])
+		}
+	}
+	return err
+}
+
+// redial replaces the i-th stream with a new connection to the session,
+// which goes on with the codec and the counts of the old one
+func (p *Pool) redial(i int) error {
+	old := p.senders[i]
+	old.Close()
+	s, err := Dial(p.ctx, p.addr, p.user, p.config, old.codec, p.session)
+	if err != nil {
+		return err
+	}
+	if p.share != nil {
+		s.limit(p.share)
+	}
+	s.raw, s.wire = old.raw, old.wire
+	p.senders[i] = s
+	return nil
+}
+
+// dropped tells whether err is the connection failing rather than the
+// receiver refusing an entry or the source failing
+func dropped(err error) bool {
+	if err == nil {
+		return false
+	}
+	var ne net.Error
+	return errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.As(err, &ne)
+}
+
+// Stats returns what the connections of the pool sent so far
+func (p *Pool) Stats() Stats {
+	st := Stats{}
+	for _, s := range p.senders {
+		sst := s.Stats()
+		st.Codec = sst.Codec
+		st.Raw += sst.Raw
+		st.Wire += sst.Wire
+	}
+	return st
+}
+
+// part is what a stream sends at once: a chunk of a large file or a batch
+// of small files
+type part struct {
+	file   *FileInfo
+	offset int64
+	size   int64
+	batch  []FileInfo
+}
+
+// committed is a file listed by a commit entry
+type committed struct {
+	Name    string
+	Size    int64
+	Mode    uint32
+	ModTime int64
+}
+
+// SyncDir makes the tree at name on the receiver match the directory at
+// path. Only the members the receiver lacks or has with another content,
+// mode or kind are sent, members the receiver has in addition are kept.
+// Directories and symlinks go first, then the files spread over the
+// streams, and the receiver confirms the whole tree is complete. progress,
+// if not nil, is called after every part sent. SyncDir returns the bytes
+// sent, compressed.
+func (p *Pool) SyncDir(path, name string, progress func(Progress)) (int64, error) {
+	start := p.Stats().Wire
+	sent := func() int64 { return p.Stats().Wire - start }
+	local, err := ListDir(path)
+	if err != nil {
+		return sent(), err
+	}
+	var exists bool
+	var remote []FileInfo
+	err = p.do(0, func(s *Sender) error {
+		var err error
+		exists, remote, err = s.List(name)
+		return err
+	})
+	if err != nil {
+		return sent(), fmt.Errorf("list %s on the receiver: %w", name, err)
+	}
+	have := make(map[string]FileInfo, len(remote))
+	for _, f := range remote {
+		have[f.Name] = f
+	}
+	if !exists {
+		have = nil
+	}
+
+	// find what differs, a file of the same size is compared by digest
+	var changed, sameSize []FileInfo
+	pr := Progress{}
+	for _, f := range local {
+		r, ok := have[f.Name]
+		if ok && r.Kind == f.Kind && r.Mode == f.Mode {
+			switch f.Kind {
+			case KindDir:
+				continue
+			case KindSymlink:
+				if r.Link == f.Link {
+					continue
+				}
+			case KindFile:
+				if r.Size == f.Size {
+					sameSize = append(sameSize, f)
+					continue
+				}
+			}
+		}
+		changed = append(changed, f)
+	}
+	same, err := p.sameContent(path, name, sameSize)
+	if err != nil {
+		return sent(), err
+	}
+	for i, f := range sameSize {
+		if same[i] {
+			pr.Skipped++
+		} else {
+			changed = append(changed, f)
+		}
+	}
+	for _, f := range changed {
+		if f.Kind == KindFile {
+			pr.TotalFiles++
+			pr.TotalBytes += f.Size
+		}
+	}
+
+	// the files go into the directories, so those come first
+	var files []FileInfo
+	for _, f := range changed {
+		dst := remoteName(name, f.Name)
+		hdr := Header{Kind: f.Kind, Name: dst, Mode: f.Mode, UID: -1, GID: -1, ModTime: f.ModTime}
+		switch f.Kind {
+		case KindDir:
+			err = p.do(0, func(s *Sender) error {
+				_, err := s.Send(hdr, strings.NewReader(""))
+				return err
+			})
+		case KindSymlink:
+			hdr.Size = int64(len(f.Link))
+			err = p.do(0, func(s *Sender) error {
+				_, err := s.Send(hdr, strings.NewReader(f.Link))
+				return err
+			})
+		case KindFile:
+			files = append(files, f)
+		}
+		if err != nil {
+			return sent(), fmt.Errorf("send %s: %w", dst, err)
+		}
+	}
+	if len(files) > 0 {
+		// every stream compresses with what the probe picked
+		err = p.do(0, func(s *Sender) error { return s.probe(path) })
+		if err != nil {
+			return sent(), err
+		}
+		for _, s := range p.senders[1:] {
+			s.codec = p.senders[0].codec
+		}
+	}
+	err = p.sendParts(path, name, split(files), &pr, progress)
+	if err == nil && progress != nil && pr.Files == 0 {
+		// tell that nothing needed sending
+		progress(pr)
+	}
+	if err != nil {
+		return sent(), err
+	}
+
+	// the receiver confirms every file of the tree is complete
+	var list []committed
+	for _, f := range local {
+		if f.Kind == KindFile {
+			list = append(list, committed{Name: f.Name, Size: f.Size, Mode: f.Mode, ModTime: f.ModTime.UnixNano()})
+		}
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		return sent(), err
+	}
+	err = p.do(0, func(s *Sender) error {
+		_, err := s.Send(Header{Kind: KindCommit, Name: name, Size: int64(len(b)), UID: -1, GID: -1}, strings.NewReader(string(b)))
+		return err
+	})
+	if err != nil {
+		return sent(), fmt.Errorf("commit %s: %w", name, err)
+	}
+	return sent(), nil
+}
+
+// sameContent tells which of the files the receiver has with the same
+// digest. The receiver hashes them on request, over all the streams.
+func (p *Pool) sameContent(path, name string, files []FileInfo) ([]bool, error) {
+	same := make([]bool, len(files))
+	queue := make(chan int)
+	stop := make(chan struct{})
+	var once sync.Once
+	var firstErr error
+	var wg sync.WaitGroup
+	for i := range p.senders {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := range queue {
+				f := files[j]
+				local, err := FileDigest(filepath.Join(path, filepath.FromSlash(f.Name)))
+				var remote string
+				if err == nil {
+					err = p.do(i, func(s *Sender) error {
+						var err error
+						remote, err = s.Digest(remoteName(name, f.Name))
+						return err
+					})
+				}
+				if err != nil {
+					once.Do(func() {
+						firstErr = fmt.Errorf("compare %s with the receiver: %w", f.Name, err)
+						close(stop)
+					})
+					return
+				}
+				same[j] = local == remote
+			}
+		}(i)
+	}
+feed:
+	for j := range files {
+		select {
+		case queue <- j:
+		case <-stop:
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return same, firstErr
+}
+
+func remoteName(name, rel string) string {
+	if rel == "." {
+		return name
+	}
+	return name + "/" + rel
+}
+
+// split cuts large files into chunks and batches small ones, the largest
+// parts first so the streams end together
+func split(files []FileInfo) []part {
+	var parts []part
+	var batch []FileInfo
+	var batched int64
+	for i := range files {
+		f := &files[i]
+		if f.Size < smallFile {
+			batch = append(batch, *f)
+			batched += f.Size
+			if batched >= batchSize {
+				parts = append(parts, part{batch: batch, size: batched})
+				batch, batched = nil, 0
+			}
+			continue
+		}
+		for off := int64(0); off < f.Size; off += partSize {
+			size := f.Size - off
+			if size > partSize {
+				size = partSize
+			}
+			parts = append(parts, part{file: f, offset: off, size: size})
+		}
+	}
+	if len(batch) > 0 {
+		parts = append(parts, part{batch: batch, size: batched})
+	}
+	sort.SliceStable(parts, func(i, j int) bool { return parts[i].size > parts[j].size })
+	return parts
+}
+
+// sendParts sends the parts over all the streams, the first failure stops
+// the others
+func (p *Pool) sendParts(path, name string, parts []part, pr *Progress, progress func(Progress)) error {
+	queue := make(chan part)
+	stop := make(chan struct{})
+	var mu sync.Mutex
+	var firstErr error
+	// left counts the chunks of every file still to send
+	left := make(map[string]int)
+	for _, pt := range parts {
+		if pt.file != nil {
+			left[pt.file.Name]++
+		}
+	}
+	done := func(pt part, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+				close(stop)
+			}
+			return
+		}
+		pr.Bytes += pt.size
+		if pt.file != nil {
+			left[pt.file.Name]--
+			if left[pt.file.Name] == 0 {
+				pr.Files++
+			}
+		} else {
+			pr.Files += len(pt.batch)
+		}
+		if progress != nil {
+			progress(*pr)
+		}
+	}
+
+	var wg sync.WaitGroup
+	for i := range p.senders {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for pt := range queue {
+				err := p.do(i, func(s *Sender) error { return s.sendPart(path, name, pt) })
+				done(pt, err)
+				if err != nil {
+					return
+				}
+			}
+		}(i)
+	}
+feed:
+	for _, pt := range parts {
+		select {
+		case queue <- pt:
+		case <-stop:
+			break feed
+		}
+	}
+	close(queue)
+	wg.Wait()
+	return firstErr
+}
+
+// sendPart sends a chunk of a file or a batch of files
+func (s *Sender) sendPart(path, name string, pt part) error {
+	if pt.batch != nil {
+		pipeR, pipeW := io.Pipe()
+		go func() {
+			pipeW.CloseWithError(WriteTar(pipeW, path, pt.batch))
+		}()
+		hdr := Header{Kind: KindTar, Name: name, Size: -1, Mode: 0o700, UID: -1, GID: -1, Codec: s.codec.Name}
+		_, err := s.Send(hdr, pipeR)
+		// unblocks the packing if the send failed
+		pipeR.CloseWithError(io.ErrClosedPipe)
+		if err != nil {
+			return fmt.Errorf("send batch of %d files: %w", len(pt.batch), err)
+		}
+		return nil
+	}
+	src := filepath.Join(path, filepath.FromSlash(pt.file.Name))
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, io.NewSectionReader(f, pt.offset, pt.size))
+	if err != nil {
+		return err
+	}
+	hdr := Header{
+		Kind:    KindChunk,
+		Name:    remoteName(name, pt.file.Name),
+		Size:    pt.size,
+		Offset:  pt.offset,
+		Mode:    pt.file.Mode,
+		UID:     -1,
+		GID:     -1,
+		ModTime: pt.file.ModTime,
+		Digest:  hex.EncodeToString(h.Sum(nil)),
+		Codec:   s.codec.Name,
+	}
+	_, err = s.Send(hdr, io.NewSectionReader(f, pt.offset, pt.size))
+	if err != nil {
+		return fmt.Errorf("send %s at %d: %w", src, pt.offset, err)
+	}
+	return nil
+}
@@ -0,0 +1,111 @@
+package transfer
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// probeSize bounds the sample the codecs are timed on
+const probeSize = 4 << 20
+
+// autoLevels are the levels auto tries the codecs at, the fast end of each
+var autoLevels = map[string]int{
+	CodecGzip: 1,
+	CodecZstd: 1,
+	CodecLz4:  1,
+}
+
+// probe picks the codec of an auto sender from a sample of the content at
+// path. The sample is sent once as is to time the connection and every
+// codec both sides have compresses it. The content moves as fast as the
+// slower of compressing it and sending it compressed, the fastest codec
+// wins. The probe isn't counted in Stats.
+func (s *Sender) probe(path string) error {
+	if s.codec.Name != CodecAuto {
+		return nil
+	}
+	sample, err := readSample(path)
+	if err != nil {
+		return err
+	}
+	s.codec = Codec{Name: CodecNone}
+	if len(sample) == 0 {
+		return nil
+	}
+	raw, wire := s.raw, s.wire
+	start := time.Now()
+	_, err = s.Send(Header{Kind: KindProbe, Name: path, Size: int64(len(sample)), UID: -1, GID: -1}, bytes.NewReader(sample))
+	if err != nil {
+		return err
+	}
+	elapsed := time.Since(start).Seconds()
+	s.raw, s.wire = raw, wire
+	bandwidth := float64(len(sample)) / elapsed
+
+	best := bandwidth
+	for _, name := range []string{CodecGzip, CodecZstd, CodecLz4} {
+		if !hasCodec(Codecs(), name) || !hasCodec(s.codecs, name) {
+			continue
+		}
+		c := Codec{Name: name, Level: autoLevels[name]}
+		start := time.Now()
+		n, err := compressedSize(c, sample)
+		if err != nil || n == 0 {
+			continue
+		}
+		elapsed := time.Since(start).Seconds()
+		rate := math.Min(float64(len(sample))/elapsed, bandwidth*float64(len(sample))/float64(n))
+		if rate > best {
+			best = rate
+			s.codec = c
+		}
+	}
+	return nil
+}
+
+// compressedSize returns the size of data compressed with c
+func compressedSize(c Codec, data []byte) (int64, error) {
+	r, release, err := compress(c, bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	return io.Copy(io.Discard, r)
+}
+
+// readSample returns up to probeSize bytes of the file at path, or of the
+// largest file under it if it's a directory
+func readSample(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		var largest int64 = -1
+		dir := path
+		path = ""
+		err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.Mode().IsRegular() && info.Size() > largest {
+				largest = info.Size()
+				path = p
+			}
+			return nil
+		})
+		if err != nil || path == "" {
+			return nil, err
+		}
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(io.LimitReader(f, probeSize))
+}
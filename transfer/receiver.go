@@ -0,0 +1,273 @@
+package transfer
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+)
+
+// Receiver receives the entries of a connection
+type Receiver struct {
+	// User owns the files of the connection
+	User string
+	// Session is shared by the connections of a transfer, empty if the
+	// sender named none
+	Session string
+	// Migration is the migration the session belongs to, if any
+	Migration string
+
+	conn  net.Conn
+	r     *bufio.Reader
+	w     *bufio.Writer
+	entry *entryReader
+}
+
+// Accept does the handshake of a connection accepted from a sender
+func Accept(conn net.Conn) (*Receiver, error) {
+	rc := &Receiver{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+		w:    bufio.NewWriter(conn),
+	}
+	h := hello{}
+	t, payload, err := readFrame(rc.r, nil)
+	if err == nil && t != frameHello {
+		err = fmt.Errorf("unexpected %v frame, want hello", t)
+	}
+	if err == nil {
+		err = json.Unmarshal(payload, &h)
+	}
+	if err == nil && h.Magic != magic {
+		err = fmt.Errorf("not a transfer connection")
+	}
+	if err == nil && h.Version != Version {
+		err = fmt.Errorf("protocol version %d isn't supported, want %d", h.Version, Version)
+	}
+	if err != nil {
+		writeJSON(rc.w, frameError, errorFrame{Message: err.Error()})
+		return nil, err
+	}
+	err = writeJSON(rc.w, frameWelcome, welcome{Version: Version, Codecs: Codecs()})
+	if err != nil {
+		return nil, err
+	}
+	rc.User = h.User
+	rc.Session = h.Session
+	rc.Migration = h.Migration
+	return rc, nil
+}
+
+// Next returns the header of the next entry and a reader of its content,
+// decompressed. The reader fails if the content doesn't match the size or
+// the digest of the header or of the end frame. Every entry must be
+// answered with Ack or Fail before the next one. Next returns io.EOF once
+// the sender is done.
+func (rc *Receiver) Next() (*Header, io.Reader, error) {
+	for {
+		hdr, r, err := rc.next()
+		if err != nil || hdr.Kind != KindProbe {
+			return hdr, r, err
+		}
+		err = rc.Ack()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+func (rc *Receiver) next() (*Header, io.Reader, error) {
+	t, payload, err := readFrame(rc.r, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t != frameHeader {
+		return nil, nil, fmt.Errorf("unexpected %v frame, want header", t)
+	}
+	hdr := &Header{}
+	err = json.Unmarshal(payload, hdr)
+	if err != nil {
+		return nil, nil, err
+	}
+	frames := &frameReader{r: rc.r, name: hdr.Name}
+	rc.entry = &entryReader{frames: frames, hdr: hdr, hash: sha256.New()}
+	rc.entry.content, rc.entry.release, err = decompress(hdr.Codec, frames)
+	if err != nil {
+		// answered by Fail once the caller sees the content fail
+		rc.entry.err = err
+	}
+	return hdr, rc.entry, nil
+}
+
+// Ack tells the sender the entry landed
+func (rc *Receiver) Ack() error {
+	e := rc.entry
+	err := e.drain()
+	if err != nil {
+		return rc.Fail(err)
+	}
+	return writeJSON(rc.w, frameAck, ack{Name: e.hdr.Name, Size: e.n})
+}
+
+// Manifest answers a list entry with the members of the tree, exists is
+// false if there is no tree
+func (rc *Receiver) Manifest(exists bool, files []FileInfo) error {
+	err := rc.entry.drain()
+	if err != nil {
+		return rc.Fail(err)
+	}
+	return writeJSON(rc.w, frameManifest, manifest{Exists: exists, Files: files})
+}
+
+// Fail tells the sender the entry failed with err
+func (rc *Receiver) Fail(err error) error {
+	// skip the rest of the entry, the connection stays usable
+	rc.entry.drain()
+	return writeJSON(rc.w, frameError, errorFrame{Message: err.Error()})
+}
+
+// entryReader reads the content of an entry, decompressed, and checks it
+// against the header and the end frame
+type entryReader struct {
+	frames  *frameReader
+	content io.Reader
+	release func()
+	hdr     *Header
+	hash    hash.Hash
+	n       int64
+	done    bool
+	err     error
+}
+
+func (e *entryReader) Read(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	if e.done {
+		return 0, io.EOF
+	}
+	n, err := e.content.Read(p)
+	if n > 0 {
+		e.n += int64(n)
+		e.hash.Write(p[:n])
+		if e.hdr.Size >= 0 && e.n > e.hdr.Size {
+			e.err = fmt.Errorf("%s is longer than %d bytes", e.hdr.Name, e.hdr.Size)
+			return 0, e.err
+		}
+	}
+	if err == io.EOF {
+		e.finish()
+		if e.err != nil {
+			return n, e.err
+		}
+	} else if err != nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// finish checks the content read against what the sender says it sent
+func (e *entryReader) finish() {
+	e.done = true
+	e.release()
+	// the codec may stop short of the end frame
+	err := e.frames.drain()
+	if err != nil {
+		e.err = err
+		return
+	}
+	end := e.frames.end
+	// the header tells what the content should be if it's known up front,
+	// the end what the sender actually sent
+	digest := hex.EncodeToString(e.hash.Sum(nil))
+	if (e.hdr.Size >= 0 && e.n != e.hdr.Size) || e.n != end.Size {
+		e.err = fmt.Errorf("%s has %d bytes, sent %d", e.hdr.Name, e.n, end.Size)
+	} else if (e.hdr.Digest != "" && digest != e.hdr.Digest) || digest != end.Digest {
+		e.err = fmt.Errorf("digest of %s is %s, sent %s", e.hdr.Name, digest, end.Digest)
+	}
+}
+
+// drain reads the entry up to its end frame and returns what's wrong with
+// it, if anything
+func (e *entryReader) drain() error {
+	if e.err == nil && !e.done {
+		_, err := io.Copy(io.Discard, e)
+		if e.err == nil {
+			e.err = err
+		}
+	}
+	if !e.done && e.release != nil {
+		e.release()
+	}
+	// skip what the content left of the entry
+	ferr := e.frames.drain()
+	if e.err == nil {
+		e.err = ferr
+	}
+	return e.err
+}
+
+// frameReader reads the data frames of an entry, compressed, up to its end
+// frame
+type frameReader struct {
+	r    *bufio.Reader
+	name string
+	buf  []byte
+	left []byte
+	wire int64
+	end  end
+	done bool
+	err  error
+}
+
+func (f *frameReader) Read(p []byte) (int, error) {
+	for len(f.left) == 0 {
+		if f.err != nil {
+			return 0, f.err
+		}
+		if f.done {
+			return 0, io.EOF
+		}
+		f.next()
+	}
+	n := copy(p, f.left)
+	f.left = f.left[n:]
+	return n, nil
+}
+
+func (f *frameReader) next() {
+	t, payload, err := readFrame(f.r, f.buf)
+	if err != nil {
+		f.err = err
+		return
+	}
+	f.buf = payload
+	switch t {
+	case frameData:
+		f.wire += int64(len(payload))
+		f.left = payload
+	case frameEnd:
+		f.done = true
+		err = json.Unmarshal(payload, &f.end)
+		if err != nil {
+			f.err = err
+		} else if f.wire != f.end.Wire {
+			f.err = fmt.Errorf("%s has %d bytes on the wire, sent %d", f.name, f.wire, f.end.Wire)
+		}
+	default:
+		f.err = fmt.Errorf("unexpected %v frame in entry %s", t, f.name)
+	}
+}
+
+// drain reads the frames up to the end frame
+func (f *frameReader) drain() error {
+	for !f.done && f.err == nil {
+		f.left = nil
+		f.next()
+	}
+	return f.err
+}
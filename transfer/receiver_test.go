@@ -0,0 +1,96 @@
+package transfer
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"strings"
+	"testing"
+)
+
+func digestOf(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestEntryChecks(t *testing.T) {
+	content := "hello"
+	tests := []struct {
+		name string
+		hdr  Header
+		data []string
+		end  end
+		// wire is added to the bytes of the data frames the end tells
+		wire int64
+		// err is part of the error reading the content, empty if none
+		err string
+	}{
+		{"complete", Header{Size: 5, Digest: digestOf(content)}, []string{"hel", "lo"}, end{Size: 5, Digest: digestOf(content)}, 0, ""},
+		{"size unknown", Header{Size: -1}, []string{content}, end{Size: 5, Digest: digestOf(content)}, 0, ""},
+		{"short of header", Header{Size: 6}, []string{content}, end{Size: 5, Digest: digestOf(content)}, 0, "has 5 bytes"},
+		{"longer than header", Header{Size: 3}, []string{content}, end{Size: 5, Digest: digestOf(content)}, 0, "longer than 3"},
+		{"short of end", Header{Size: -1}, []string{content}, end{Size: 6, Digest: digestOf(content)}, 0, "has 5 bytes"},
+		{"header digest", Header{Size: 5, Digest: digestOf("world")}, []string{content}, end{Size: 5, Digest: digestOf(content)}, 0, "digest of"},
+		{"end digest", Header{Size: -1}, []string{content}, end{Size: 5, Digest: digestOf("world")}, 0, "digest of"},
+		{"frames lost", Header{Size: -1}, []string{content}, end{Size: 5, Digest: digestOf(content)}, 3, "on the wire"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := bufio.NewWriter(&buf)
+			tt.hdr.Kind = KindFile
+			tt.hdr.Name = "/f"
+			writeJSON(w, frameHeader, tt.hdr)
+			for _, d := range tt.data {
+				writeFrame(w, frameData, []byte(d))
+				tt.end.Wire += int64(len(d))
+			}
+			tt.end.Wire += tt.wire
+			writeJSON(w, frameEnd, tt.end)
+			rc := &Receiver{r: bufio.NewReader(&buf), w: bufio.NewWriter(io.Discard)}
+			_, r, err := rc.Next()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(r)
+			if tt.err == "" {
+				if err != nil || string(got) != content {
+					t.Errorf("read %q, %v, want %q", got, err, content)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("error = %v, want one with %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestEntryCompressed(t *testing.T) {
+	content := strings.Repeat("checkpoint ", 1000)
+	zr, release, err := compress(Codec{Name: CodecGzip}, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer release()
+	z, err := io.ReadAll(zr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	w := bufio.NewWriter(&buf)
+	writeJSON(w, frameHeader, Header{Kind: KindFile, Name: "/f", Size: int64(len(content)), Codec: CodecGzip})
+	writeFrame(w, frameData, z)
+	writeJSON(w, frameEnd, end{Size: int64(len(content)), Digest: digestOf(content), Wire: int64(len(z))})
+	rc := &Receiver{r: bufio.NewReader(&buf), w: bufio.NewWriter(io.Discard)}
+	_, r, err := rc.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(r)
+	if err != nil || string(got) != content {
+		t.Errorf("read %d bytes, %v, want %d", len(got), err, len(content))
+	}
+}
@@ -0,0 +1,262 @@
+package transfer
+
+import (
+	"bufio"
+	"context"
+	"cr/util"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Sender sends entries over a connection
+type Sender struct {
+	conn net.Conn
+	r    *bufio.Reader
+	w    *bufio.Writer
+	stop chan struct{}
+	once sync.Once
+	// codec compresses files and tarballs, auto until probed
+	codec Codec
+	// codecs are those the receiver has
+	codecs []string
+	// raw and wire count the content sent, before and after compression
+	raw  int64
+	wire int64
+}
+
+// Dial connects to the receiver at addr, over TLS if config isn't nil, and
+// does the handshake, the files sent belong to user. Connections naming the
+// same session share what the receiver tracks of them, see Session. Files
+// and tarballs are compressed with codec, which both sides must have,
+// CodecAuto probes for the best one on the first of them. The connection is
+// closed once ctx is done, which fails a transfer in flight.
+func Dial(ctx context.Context, addr, user string, config *tls.Config, codec Codec, session Session) (*Sender, error) {
+	err := codec.Validate()
+	if err != nil {
+		return nil, err
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if config != nil {
+		tconn := tls.Client(conn, util.TLSClient(config, addr))
+		err = tconn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tconn
+	}
+	// a connection which silently went away fails rather than hangs
+	conn = &stallConn{Conn: conn}
+	s := &Sender{
+		conn:  conn,
+		r:     bufio.NewReader(conn),
+		w:     bufio.NewWriterSize(conn, chunkSize+5),
+		stop:  make(chan struct{}),
+		codec: codec,
+	}
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-s.stop:
+		}
+	}()
+	err = writeJSON(s.w, frameHello, hello{Magic: magic, Version: Version, User: user, Session: session.ID, Migration: session.Migration})
+	if err == nil {
+		w := welcome{}
+		err = readReply(s.r, frameWelcome, &w)
+		s.codecs = w.Codecs
+	}
+	if err == nil && codec.Name != CodecAuto && !(hasCodec(Codecs(), codec.Name) && hasCodec(s.codecs, codec.Name)) {
+		err = fmt.Errorf("codec %s isn't available on both sides", codec.Name)
+	}
+	if err != nil {
+		s.Close()
+		return nil, fmt.Errorf("handshake with %s: %w", addr, err)
+	}
+	return s, nil
+}
+
+// Session groups the connections of a transfer on the receiver
+type Session struct {
+	// ID names the session, a connection without one is on its own
+	ID string
+	// Migration is the migration the transfer belongs to, the receiver
+	// tells the migrator once the session committed its tree
+	Migration string
+}
+
+// Stats tells what a sender sent
+type Stats struct {
+	// Codec compressed the files and tarballs, auto if none was sent
+	Codec Codec
+	// Raw and Wire count the content sent, before and after compression
+	Raw  int64
+	Wire int64
+}
+
+// Stats returns what the sender sent so far
+func (s *Sender) Stats() Stats {
+	return Stats{Codec: s.codec, Raw: s.raw, Wire: s.wire}
+}
+
+// limit makes what the sender writes keep to the rate of share, it must be
+// called between entries
+func (s *Sender) limit(share *Share) {
+	s.w.Reset(share.Writer(s.conn))
+}
+
+func (s *Sender) Close() error {
+	err := net.ErrClosed
+	s.once.Do(func() {
+		close(s.stop)
+		err = s.conn.Close()
+	})
+	return err
+}
+
+// SendFile sends the file at path as name and waits for the receiver to
+// ack it. It returns the bytes sent, compressed.
+func (s *Sender) SendFile(path, name string) (int64, error) {
+	err := s.probe(path)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return 0, err
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err != nil {
+		return 0, err
+	}
+	hdr := fileHeader(KindFile, name, info)
+	hdr.Size = info.Size()
+	hdr.Digest = hex.EncodeToString(h.Sum(nil))
+	hdr.Codec = s.codec.Name
+	return s.Send(hdr, f)
+}
+
+func fileHeader(kind, name string, info os.FileInfo) Header {
+	hdr := Header{
+		Kind:    kind,
+		Name:    name,
+		Size:    -1,
+		Mode:    uint32(info.Mode().Perm()),
+		UID:     -1,
+		GID:     -1,
+		ModTime: info.ModTime(),
+	}
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		hdr.UID = int(st.Uid)
+		hdr.GID = int(st.Gid)
+	}
+	return hdr
+}
+
+// Send sends an entry with the content read from r, which must match hdr,
+// compressed with hdr.Codec, and waits for the receiver to ack it. It
+// returns the bytes sent, compressed.
+func (s *Sender) Send(hdr Header, r io.Reader) (int64, error) {
+	err := writeJSON(s.w, frameHeader, hdr)
+	if err != nil {
+		return 0, err
+	}
+	h := sha256.New()
+	counter := &countingReader{r: io.TeeReader(r, h)}
+	codec := Codec{Name: hdr.Codec}
+	if codec.Name == s.codec.Name {
+		codec.Level = s.codec.Level
+	}
+	content, release, err := compress(codec, counter)
+	if err != nil {
+		return 0, err
+	}
+	defer release()
+	var wire int64
+	buf := make([]byte, chunkSize)
+	for {
+		m, rerr := content.Read(buf)
+		if m > 0 {
+			err = writeFrame(s.w, frameData, buf[:m])
+			if err != nil {
+				return wire, err
+			}
+			wire += int64(m)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			return wire, rerr
+		}
+	}
+	n := counter.n
+	err = writeJSON(s.w, frameEnd, end{Size: n, Digest: hex.EncodeToString(h.Sum(nil)), Wire: wire})
+	if err != nil {
+		return wire, err
+	}
+	a := ack{}
+	err = readReply(s.r, frameAck, &a)
+	if err != nil {
+		return wire, err
+	}
+	if a.Size != n {
+		return wire, fmt.Errorf("receiver acked %d bytes of %s, sent %d", a.Size, hdr.Name, n)
+	}
+	s.raw += n
+	s.wire += wire
+	return wire, nil
+}
+
+// stallTimeout bounds how long a read or write on a connection may block
+const stallTimeout = time.Minute
+
+// stallConn fails a read or write which makes no progress in stallTimeout
+type stallConn struct {
+	net.Conn
+}
+
+func (c *stallConn) Read(p []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(stallTimeout))
+	return c.Conn.Read(p)
+}
+
+func (c *stallConn) Write(p []byte) (int, error) {
+	c.Conn.SetWriteDeadline(time.Now().Add(stallTimeout))
+	return c.Conn.Write(p)
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,134 @@
+package transfer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileInfo describes a member of a directory tree
+type FileInfo struct {
+	// Name is the path relative to the tree, "." for the tree itself
+	Name    string
+	Kind    string
+	Size    int64
+	Mode    uint32
+	ModTime time.Time
+	// Digest is the sha256 of a file, hex encoded, only in the answer to a
+	// digest entry
+	Digest string
+	// Link is the target of a symlink
+	Link string
+}
+
+// manifest answers a list entry with the members of the tree
+type manifest struct {
+	// Exists is false if there is no tree yet
+	Exists bool
+	Files  []FileInfo
+}
+
+// Progress tells how far a sync got
+type Progress struct {
+	// Files and Bytes are what was sent so far of the TotalFiles and
+	// TotalBytes which differ on the receiver
+	Files      int
+	TotalFiles int
+	Bytes      int64
+	TotalBytes int64
+	// Skipped is how many files the receiver already had
+	Skipped int
+}
+
+// ListDir returns the members of the tree under dir, parents before their
+// children, without the digests of the files. Symlinks are listed, not
+// followed.
+func ListDir(dir string) ([]FileInfo, error) {
+	var files []FileInfo
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		f := FileInfo{
+			Name:    filepath.ToSlash(rel),
+			Mode:    uint32(info.Mode().Perm()),
+			ModTime: info.ModTime(),
+		}
+		switch {
+		case info.IsDir():
+			f.Kind = KindDir
+		case info.Mode().IsRegular():
+			f.Kind = KindFile
+			f.Size = info.Size()
+		case info.Mode()&os.ModeSymlink != 0:
+			f.Kind = KindSymlink
+			f.Link, err = os.Readlink(path)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("%s isn't a file, a directory or a symlink", path)
+		}
+		files = append(files, f)
+		return nil
+	})
+	return files, err
+}
+
+// FileDigest returns the sha256 of the file at path, hex encoded
+func FileDigest(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// List asks the receiver for the members of the tree at name
+func (s *Sender) List(name string) (bool, []FileInfo, error) {
+	err := writeJSON(s.w, frameHeader, Header{Kind: KindList, Name: name})
+	if err == nil {
+		err = writeJSON(s.w, frameEnd, end{Digest: emptyDigest})
+	}
+	if err != nil {
+		return false, nil, err
+	}
+	m := manifest{}
+	err = readReply(s.r, frameManifest, &m)
+	return m.Exists, m.Files, err
+}
+
+// Digest asks the receiver for the digest of the file at name, it's empty
+// if there is no file there
+func (s *Sender) Digest(name string) (string, error) {
+	err := writeJSON(s.w, frameHeader, Header{Kind: KindDigest, Name: name})
+	if err == nil {
+		err = writeJSON(s.w, frameEnd, end{Digest: emptyDigest})
+	}
+	if err != nil {
+		return "", err
+	}
+	m := manifest{}
+	err = readReply(s.r, frameManifest, &m)
+	if err != nil || !m.Exists || len(m.Files) != 1 {
+		return "", err
+	}
+	return m.Files[0].Digest, nil
+}
+
+// emptyDigest is the sha256 of no content
+var emptyDigest = hex.EncodeToString(sha256.New().Sum(nil))
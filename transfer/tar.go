@@ -0,0 +1,240 @@
+package transfer
+
+import (
+	"archive/tar"
+	"cr/util"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// WriteTar packs the regular files of the tree under dir named by files
+// into a tarball written to w, the members are named as in files
+func WriteTar(w io.Writer, dir string, files []FileInfo) error {
+	tw := tar.NewWriter(w)
+	for _, f := range files {
+		err := writeTarFile(tw, filepath.Join(dir, filepath.FromSlash(f.Name)), f.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func writeTarFile(tw *tar.Writer, path, name string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s isn't a regular file", path)
+	}
+	hdr, err := tar.FileInfoHeader(info, "")
+	if err != nil {
+		return err
+	}
+	hdr.Name = name
+	err = tw.WriteHeader(hdr)
+	if err != nil {
+		return err
+	}
+	// the file may grow while it's packed, the header has its size
+	_, err = io.Copy(tw, io.LimitReader(file, info.Size()))
+	return err
+}
+
+// ExtractTar unpacks the tarball read from r into dir, keeping the
+// modes and the modification times of its members. Everything is owned by
+// uid and gid. Members which would land outside of dir, directly or through
+// a symlink, fail the extraction. confine, if not nil, checks where every
+// member may land and returns the path to write it to, it fails the
+// extraction otherwise.
+func ExtractTar(r io.Reader, dir string, uid, gid int, confine func(path string) (string, error)) error {
+	tr := tar.NewReader(r)
+	// the members of a directory change its modification time, so it's
+	// set once they're all there
+	type dirTime struct {
+		path string
+		t    time.Time
+	}
+	var dirs []dirTime
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		path, err := memberPath(dir, hdr.Name)
+		if err == nil && confine != nil {
+			path, err = confine(path)
+		}
+		if err != nil {
+			return err
+		}
+		mode := os.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			err = extractDir(path, mode, uid, gid)
+			dirs = append(dirs, dirTime{path, hdr.ModTime})
+		case tar.TypeReg:
+			err = extractFile(path, mode, uid, gid, hdr.ModTime, tr)
+		case tar.TypeSymlink:
+			err = linkWithin(dir, path, hdr.Linkname)
+			if err == nil {
+				os.Remove(path)
+				err = os.Symlink(hdr.Linkname, path)
+			}
+			if err == nil {
+				err = os.Lchown(path, uid, gid)
+			}
+		default:
+			err = fmt.Errorf("tar member %s has unsupported type %c", hdr.Name, hdr.Typeflag)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		err := setDirTime(dirs[i].path, dirs[i].t)
+		if err != nil {
+			return err
+		}
+	}
+	// read up to the end so a truncated stream is told
+	_, err := io.Copy(io.Discard, r)
+	return err
+}
+
+// openDir opens the directory at path, failing if it's anything else,
+// a symlink to a directory included
+func openDir(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_DIRECTORY|syscall.O_NOFOLLOW, 0)
+	if errors.Is(err, syscall.ELOOP) || errors.Is(err, syscall.ENOTDIR) {
+		return nil, fmt.Errorf("%s exists and isn't a directory", path)
+	}
+	return f, err
+}
+
+// extractDir creates the directory at path, or takes the one there, and
+// sets its owner and mode
+func extractDir(path string, mode os.FileMode, uid, gid int) error {
+	err := os.Mkdir(path, mode)
+	if err != nil && !os.IsExist(err) {
+		return err
+	}
+	f, err := openDir(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	err = f.Chown(uid, gid)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	return err
+}
+
+func setDirTime(path string, t time.Time) error {
+	f, err := openDir(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return util.SetFileTime(f, t)
+}
+
+// linkWithin checks the symlink at path to link stays under dir. link is
+// walked as the kernel would, so it may not go through a symlink.
+func linkWithin(dir, path, link string) error {
+	if filepath.IsAbs(link) {
+		return fmt.Errorf("symlink %s links outside of %s", path, dir)
+	}
+	p := filepath.Dir(path)
+	for _, part := range strings.Split(link, "/") {
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			p = filepath.Dir(p)
+		default:
+			p = filepath.Join(p, part)
+			info, err := os.Lstat(p)
+			if err == nil && info.Mode()&os.ModeSymlink != 0 {
+				return fmt.Errorf("symlink %s links through symlink %s", path, p)
+			}
+		}
+		if !within(dir, p) {
+			return fmt.Errorf("symlink %s links outside of %s", path, dir)
+		}
+	}
+	return nil
+}
+
+// within tells whether path is dir or lies under it
+func within(dir, path string) bool {
+	return path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
+
+// memberPath returns where the tar member name lands under dir. Absolute
+// names, ".." and parents which aren't plain directories are refused.
+func memberPath(dir, name string) (string, error) {
+	if filepath.IsAbs(name) || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("tar member %s is absolute", name)
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", fmt.Errorf("tar member %s escapes with ..", name)
+		}
+	}
+	path := filepath.Join(dir, filepath.FromSlash(name))
+	if path == dir {
+		return "", fmt.Errorf("tar member %s is the directory itself", name)
+	}
+	// a symlink on the way would lead outside, the member itself is
+	// replaced rather than followed
+	for p := filepath.Dir(path); p != dir; p = filepath.Dir(p) {
+		info, err := os.Lstat(p)
+		if err != nil {
+			return "", err
+		}
+		if !info.IsDir() {
+			return "", fmt.Errorf("parent %s of tar member %s isn't a directory", p, name)
+		}
+	}
+	return path, nil
+}
+
+func extractFile(path string, mode os.FileMode, uid, gid int, modTime time.Time, r io.Reader) error {
+	// don't write through a symlink left at path
+	os.Remove(path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|syscall.O_NOFOLLOW, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, r)
+	if err == nil {
+		err = f.Chown(uid, gid)
+	}
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if err == nil {
+		err = util.SetFileTime(f, modTime)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package transfer
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+type member struct {
+	name string
+	kind byte
+	// body is the content of a file or the target of a symlink
+	body string
+}
+
+func tarball(t *testing.T, members []member) *bytes.Buffer {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, m := range members {
+		hdr := &tar.Header{Name: m.name, Typeflag: m.kind, Mode: 0o640, ModTime: time.Unix(1600000000, 0)}
+		switch m.kind {
+		case tar.TypeReg:
+			hdr.Size = int64(len(m.body))
+		case tar.TypeDir:
+			hdr.Mode = 0o750
+		case tar.TypeSymlink:
+			hdr.Linkname = m.body
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if m.kind == tar.TypeReg {
+			tw.Write([]byte(m.body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestExtractTar(t *testing.T) {
+	refuseSecret := func(path string) (string, error) {
+		if filepath.Base(path) == "secret" {
+			return "", fmt.Errorf("%s is refused", path)
+		}
+		return path, nil
+	}
+	tests := []struct {
+		name    string
+		members []member
+		confine func(string) (string, error)
+		// err is part of the error of the extraction, empty if none
+		err string
+	}{
+		{"tree", []member{{"d", tar.TypeDir, ""}, {"d/f", tar.TypeReg, "data"}, {"l", tar.TypeSymlink, "d/f"}}, nil, ""},
+		{"absolute", []member{{"/etc/passwd", tar.TypeReg, "x"}}, nil, "is absolute"},
+		{"dot dot", []member{{"d/../../x", tar.TypeReg, "x"}}, nil, "escapes"},
+		{"dir itself", []member{{".", tar.TypeDir, ""}}, nil, "directory itself"},
+		{"through symlink", []member{{"out/x", tar.TypeReg, "x"}}, nil, "isn't a directory"},
+		{"symlink outside", []member{{"l", tar.TypeSymlink, "../../etc"}}, nil, "links outside"},
+		{"absolute symlink", []member{{"l", tar.TypeSymlink, "/etc"}}, nil, "links outside"},
+		{"dir over symlink", []member{{"l", tar.TypeSymlink, "."}, {"l", tar.TypeDir, ""}}, nil, "isn't a directory"},
+		{"link through symlink", []member{{"s", tar.TypeSymlink, "."}, {"t", tar.TypeSymlink, "s/.."}}, nil, "through symlink"},
+		{"unsupported", []member{{"p", tar.TypeFifo, ""}}, nil, "unsupported type"},
+		{"confined", []member{{"f", tar.TypeReg, "x"}}, refuseSecret, ""},
+		{"refused", []member{{"f", tar.TypeReg, "x"}, {"secret", tar.TypeReg, "x"}}, refuseSecret, "is refused"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			outside := t.TempDir()
+			// a symlink to outside of dir must never be written through
+			if err := os.Symlink(outside, filepath.Join(dir, "out")); err != nil {
+				t.Fatal(err)
+			}
+			err := ExtractTar(tarball(t, tt.members), dir, os.Getuid(), os.Getgid(), tt.confine)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("error = %v, want one with %q", err, tt.err)
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			entries, _ := os.ReadDir(outside)
+			if len(entries) > 0 {
+				t.Errorf("extraction wrote %s outside of the dir", entries[0].Name())
+			}
+		})
+	}
+}
+
+func TestExtractTarKeepsMetadata(t *testing.T) {
+	dir := t.TempDir()
+	members := []member{{"d", tar.TypeDir, ""}, {"d/f", tar.TypeReg, "data"}}
+	err := ExtractTar(tarball(t, members), dir, os.Getuid(), os.Getgid(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []struct {
+		name string
+		mode os.FileMode
+	}{{"d", 0o750}, {"d/f", 0o640}} {
+		info, err := os.Stat(filepath.Join(dir, m.name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != m.mode {
+			t.Errorf("mode of %s = %v, want %v", m.name, info.Mode().Perm(), m.mode)
+		}
+		if !info.ModTime().Equal(time.Unix(1600000000, 0)) {
+			t.Errorf("mtime of %s = %v", m.name, info.ModTime())
+		}
+	}
+	b, err := os.ReadFile(filepath.Join(dir, "d", "f"))
+	if err != nil || string(b) != "data" {
+		t.Errorf("content = %q, %v", b, err)
+	}
+}
+
+func TestExtractTarStaysInside(t *testing.T) {
+	parent := t.TempDir()
+	dir := filepath.Join(parent, "ckpt")
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(parent, 0o700); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.Stat(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// t resolves to the parent of dir through s, the dir member t then
+	// would chmod and chtimes it
+	members := []member{{"s", tar.TypeSymlink, "."}, {"t", tar.TypeSymlink, "s/.."}, {"t", tar.TypeDir, ""}}
+	if err := ExtractTar(tarball(t, members), dir, os.Getuid(), os.Getgid(), nil); err == nil {
+		t.Error("extraction passed")
+	}
+	after, err := os.Stat(parent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Mode() != before.Mode() || !after.ModTime().Equal(before.ModTime()) {
+		t.Errorf("parent went from %v %v to %v %v", before.Mode(), before.ModTime(), after.Mode(), after.ModTime())
+	}
+}
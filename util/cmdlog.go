@@ -0,0 +1,185 @@
+package util
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+const (
+	// maxCmdOutput bounds the output kept in a CommandError, from its end
+	maxCmdOutput = 64 << 10
+)
+
+type logDirKey struct{}
+
+// LogDir keeps the output of the child processes of a migration, one file
+// per command
+type LogDir struct {
+	Path string
+	// uid and gid own the dir and its files, -1 for root
+	uid int
+	gid int
+
+	mu  sync.Mutex
+	seq int
+}
+
+// NewLogDir creates the log dir at path for the migration of userName, only
+// the user may read it. An empty userName leaves it to root.
+func NewLogDir(path, userName string) (*LogDir, error) {
+	d := &LogDir{Path: path, uid: -1, gid: -1}
+	if userName != "" {
+		uid, gid, err := getUIDAndGID(userName)
+		if err != nil {
+			return nil, err
+		}
+		d.uid, d.gid = int(uid), int(gid)
+	}
+	err := os.MkdirAll(path, 0700)
+	if err != nil {
+		return nil, err
+	}
+	return d, os.Lchown(path, d.uid, d.gid)
+}
+
+// Create creates the file name in the log dir for the user, replacing the
+// one there
+func (d *LogDir) Create(name string) (*os.File, error) {
+	path := filepath.Join(d.Path, name)
+	os.Remove(path)
+	return d.open(path)
+}
+
+func (d *LogDir) open(path string) (*os.File, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = f.Chown(d.uid, d.gid)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+// WithLogDir returns a context whose commands log into d
+func WithLogDir(ctx context.Context, d *LogDir) context.Context {
+	return context.WithValue(ctx, logDirKey{}, d)
+}
+
+// LogDirFrom returns the LogDir of ctx, nil if it has none
+func LogDirFrom(ctx context.Context) *LogDir {
+	d, _ := ctx.Value(logDirKey{}).(*LogDir)
+	return d
+}
+
+// create opens a new log file named after the command args. Several LogDirs
+// may share a directory, the sequence number skips the files already there.
+func (d *LogDir) create(args []string) (*os.File, error) {
+	name := filepath.Base(args[0])
+	if len(args) > 1 && !strings.HasPrefix(args[1], "-") {
+		name += "-" + args[1]
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for {
+		d.seq++
+		f, err := d.open(filepath.Join(d.Path, fmt.Sprintf("%03d-%s.log", d.seq, name)))
+		if !os.IsExist(err) {
+			return f, err
+		}
+	}
+}
+
+// StartCmd starts cmd with its stdout and stderr in a log file of the LogDir
+// of ctx, or in a temporary file if ctx has none. The file itself is handed
+// to the child rather than a pipe, so neither a daemon the command leaves
+// behind nor a child outliving the server hold anything up. The returned
+// function waits for cmd and returns the end of its output, with a
+// CommandError if it failed.
+func StartCmd(ctx context.Context, cmd *exec.Cmd) (func() (string, error), error) {
+	var f *os.File
+	var err error
+	d := LogDirFrom(ctx)
+	if d != nil {
+		f, err = d.create(cmd.Args)
+	} else {
+		f, err = os.CreateTemp("", "cmd-*.log")
+	}
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(f, "$ %s\n", strings.Join(cmd.Args, " "))
+	cmd.Stdout = f
+	cmd.Stderr = f
+	err = cmd.Start()
+	if err != nil {
+		closeCmdLog(f, d == nil)
+		return nil, &CommandError{Args: cmd.Args, Err: err}
+	}
+	return func() (string, error) {
+		err := cmd.Wait()
+		out, _, _ := ReadTail(f.Name(), maxCmdOutput)
+		closeCmdLog(f, d == nil)
+		if err != nil {
+			return string(out), &CommandError{Args: cmd.Args, Err: err, Output: string(out)}
+		}
+		return string(out), nil
+	}, nil
+}
+
+// RunCmd runs cmd like StartCmd and waits for it
+func RunCmd(ctx context.Context, cmd *exec.Cmd) error {
+	_, err := RunCmdOutput(ctx, cmd)
+	return err
+}
+
+// RunCmdOutput runs cmd like StartCmd and returns the end of its output
+func RunCmdOutput(ctx context.Context, cmd *exec.Cmd) (string, error) {
+	wait, err := StartCmd(ctx, cmd)
+	if err != nil {
+		return "", err
+	}
+	return wait()
+}
+
+func closeCmdLog(f *os.File, temp bool) {
+	f.Close()
+	if temp {
+		os.Remove(f.Name())
+	}
+}
+
+// ReadTail returns the last max bytes of the regular file at path and
+// whether the file had more. A symlink at path isn't followed.
+func ReadTail(path string, max int64) ([]byte, bool, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY|syscall.O_NOFOLLOW|syscall.O_NONBLOCK, 0)
+	if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, false, err
+	}
+	if !info.Mode().IsRegular() {
+		return nil, false, fmt.Errorf("%s isn't a regular file", path)
+	}
+	truncated := info.Size() > max
+	if truncated {
+		_, err = f.Seek(info.Size()-max, io.SeekStart)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	data, err := io.ReadAll(f)
+	return data, truncated, err
+}
@@ -0,0 +1,83 @@
+package util
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strings"
+)
+
+// PeerFilter is the addresses and networks peers may connect from, nil
+// admits any
+type PeerFilter []*net.IPNet
+
+// ParsePeers parses comma separated IP addresses and CIDR networks
+func ParsePeers(s string) (PeerFilter, error) {
+	var f PeerFilter
+	for _, p := range strings.Split(s, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		if !strings.Contains(p, "/") {
+			ip := net.ParseIP(p)
+			if ip == nil {
+				return nil, fmt.Errorf("bad peer address %q", p)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			f = append(f, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(p)
+		if err != nil {
+			return nil, fmt.Errorf("bad peer network %q", p)
+		}
+		f = append(f, n)
+	}
+	return f, nil
+}
+
+// Admits tells whether a peer at addr may connect
+func (f PeerFilter) Admits(addr net.Addr) bool {
+	if f == nil {
+		return true
+	}
+	tcp, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, n := range f {
+		if n.Contains(tcp.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener returns l closing the connections of the peers f doesn't admit
+// right away
+func (f PeerFilter) Listener(l net.Listener) net.Listener {
+	if f == nil {
+		return l
+	}
+	return &filteredListener{Listener: l, f: f}
+}
+
+type filteredListener struct {
+	net.Listener
+	f PeerFilter
+}
+
+func (l *filteredListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil || l.f.Admits(conn.RemoteAddr()) {
+			return conn, err
+		}
+		log.Printf("refuse connection from %v, not an allowed peer", conn.RemoteAddr())
+		conn.Close()
+	}
+}
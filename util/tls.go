@@ -0,0 +1,76 @@
+package util
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// TLSConfig builds the mutual TLS config of a node, used both to serve and
+// to dial peers. Peers must present a certificate signed by the CA in
+// caFile, and if pins are given one whose SHA-256 fingerprint is among
+// them. With pins only, the CA isn't checked.
+func TLSConfig(certFile, keyFile, caFile string, pins []string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load certificate %s: %v", certFile, err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequireAnyClientCert,
+		MinVersion:   tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate in %s", caFile)
+		}
+		config.RootCAs = pool
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if len(pins) == 0 {
+		return nil, fmt.Errorf("peers can't be verified without a CA or pins")
+	}
+	if len(pins) > 0 {
+		pinned := make(map[string]bool)
+		for _, pin := range pins {
+			pinned[strings.ToLower(strings.ReplaceAll(pin, ":", ""))] = true
+		}
+		if caFile == "" {
+			// the pins verify the peers instead of a chain
+			config.InsecureSkipVerify = true
+		}
+		config.VerifyPeerCertificate = func(raw [][]byte, _ [][]*x509.Certificate) error {
+			if len(raw) == 0 {
+				return fmt.Errorf("peer sent no certificate")
+			}
+			sum := sha256.Sum256(raw[0])
+			if !pinned[hex.EncodeToString(sum[:])] {
+				return fmt.Errorf("peer certificate %x isn't pinned", sum)
+			}
+			return nil
+		}
+	}
+	return config, nil
+}
+
+// TLSClient returns config to dial addr with, nil if TLS is off
+func TLSClient(config *tls.Config, addr string) *tls.Config {
+	if config == nil {
+		return nil
+	}
+	c := config.Clone()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		c.ServerName = host
+	}
+	return c
+}
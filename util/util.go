@@ -1,15 +1,23 @@
 package util
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"os/user"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"syscall"
+	"time"
+	"unsafe"
 )
 
 // MountTmpfs mounts a tmpfs at the given path
@@ -49,53 +57,273 @@ func getUIDAndGID(name string) (int64, int64, error) {
 	return uid, gid, nil
 }
 
-// execute command as another user
-func RunCmdAsUser(cmd *exec.Cmd, user string) error {
-	uid, gid, err := getUIDAndGID(user)
+// AsUser makes cmd run as the named user, with its uid, gid and
+// supplementary groups, in its home directory and with the environment of a
+// login of the user. A server already running as the user keeps its
+// credentials, it couldn't set the groups.
+func AsUser(cmd *exec.Cmd, name string) error {
+	u, err := user.Lookup(name)
+	if err != nil {
+		return fmt.Errorf("user %s not found", name)
+	}
+	uid, gid, err := getUIDAndGID(name)
 	if err != nil {
 		return err
 	}
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	log.Printf("username %s, uid %d, gid %d", user, uid, gid)
-	cmd.SysProcAttr = &syscall.SysProcAttr{}
-	cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}
-	return cmd.Run()
+	if int(uid) != os.Getuid() {
+		ids, err := u.GroupIds()
+		if err != nil {
+			return fmt.Errorf("failed to get groups of user %s: %v", name, err)
+		}
+		groups := make([]uint32, 0, len(ids))
+		for _, id := range ids {
+			g, err := strconv.ParseUint(id, 10, 32)
+			if err != nil {
+				return fmt.Errorf("failed to parse group id: %v", err)
+			}
+			groups = append(groups, uint32(g))
+		}
+		if cmd.SysProcAttr == nil {
+			cmd.SysProcAttr = &syscall.SysProcAttr{}
+		}
+		cmd.SysProcAttr.Credential = &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: groups}
+	}
+	cmd.Env = userEnv(u)
+	if cmd.Dir == "" {
+		// the user may not be able to enter the directory of the server
+		cmd.Dir = "/"
+		if fi, err := os.Stat(u.HomeDir); err == nil && fi.IsDir() {
+			cmd.Dir = u.HomeDir
+		}
+	}
+	return nil
 }
 
-func SendFile(conn net.Conn, filepath string) error {
-	file, err := os.Open(filepath)
-	if err != nil {
-		log.Printf("open file %s failed: %v", filepath, err)
-		return err
+// userEnv returns the environment of a login of u, the server only passes on
+// where to find the commands and the locale
+func userEnv(u *user.User) []string {
+	env := []string{
+		"HOME=" + u.HomeDir,
+		"USER=" + u.Username,
+		"LOGNAME=" + u.Username,
 	}
-	defer file.Close()
-	_, err = io.Copy(conn, file)
+	for _, key := range []string{"PATH", "LANG", "LC_ALL", "TZ"} {
+		if v, ok := os.LookupEnv(key); ok {
+			env = append(env, key+"="+v)
+		}
+	}
+	if os.Getenv("PATH") == "" {
+		env = append(env, "PATH=/usr/local/bin:/usr/bin:/bin")
+	}
+	return env
+}
+
+// RunCmdAsUser runs cmd like RunCmd as the named user
+func RunCmdAsUser(ctx context.Context, cmd *exec.Cmd, user string) error {
+	_, err := RunCmdOutputAsUser(ctx, cmd, user)
 	return err
 }
 
-func ReceiveFile(conn net.Conn, filepath string) error {
-	file, err := os.Create(filepath)
+// RunCmdOutputAsUser runs cmd like RunCmdOutput as the named user
+func RunCmdOutputAsUser(ctx context.Context, cmd *exec.Cmd, user string) (string, error) {
+	err := AsUser(cmd, user)
 	if err != nil {
-		log.Printf("create file %v failed: %v", filepath, err)
-		return err
+		return "", err
 	}
-	defer file.Close()
-	_, err = io.Copy(file, conn)
-	return err
+	return RunCmdOutput(ctx, cmd)
 }
 
-func DoRsync(userName, checkpointDir, targetIP string) error {
-	cmd := exec.Command(
-		"rsync",
-		"-av",
-		checkpointDir+"/",
-		userName+"@"+targetIP+":"+checkpointDir,
-	)
-	log.Printf("do rsync at %v", checkpointDir)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err := cmd.Run()
-	log.Printf("finish rsync at %v", checkpointDir)
-	return err
+// DoRsync syncs checkpointDir to the same path on targetIP as userName and
+// returns the bytes rsync sent, rsync is killed if ctx is done. rsync sends
+// at most bwlimit bytes per second if it isn't zero. If the connection
+// drops, rsync runs again after a backoff and picks up from the files and
+// partial files already there.
+func DoRsync(ctx context.Context, userName, checkpointDir, targetIP string, bwlimit int64) (int64, error) {
+	args := []string{"-av", "--stats", "--partial", "--timeout=60"}
+	if bwlimit > 0 {
+		// rsync counts in KiB per second, 0 would turn the cap off
+		kib := bwlimit / 1024
+		if kib < 1 {
+			kib = 1
+		}
+		args = append(args, fmt.Sprintf("--bwlimit=%d", kib))
+	}
+	args = append(args, checkpointDir+"/", userName+"@"+targetIP+":"+checkpointDir)
+	var sent int64
+	backoff := rsyncBackoff
+	for attempt := 0; ; attempt++ {
+		cmd := exec.CommandContext(ctx, "rsync", args...)
+		log.Printf("do rsync at %v", checkpointDir)
+		out, err := RunCmdOutputAsUser(ctx, cmd, userName)
+		log.Printf("finish rsync at %v", checkpointDir)
+		sent += rsyncBytesSent(out)
+		if err == nil || attempt == rsyncAttempts || !rsyncDropped(err) || ctx.Err() != nil {
+			return sent, err
+		}
+		log.Printf("rsync of %s dropped: %v, resuming in %v", checkpointDir, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return sent, err
+		}
+		backoff *= 2
+	}
+}
+
+const (
+	// rsyncAttempts bounds how many times rsync runs again after its
+	// connection dropped, rsyncBackoff is the wait before the first time,
+	// doubled after every failure
+	rsyncAttempts = 5
+	rsyncBackoff  = time.Second
+)
+
+// rsyncDropped tells whether rsync failed on its connection: a socket or
+// protocol error, a timeout or ssh failing
+func rsyncDropped(err error) bool {
+	var exit *exec.ExitError
+	if !errors.As(err, &exit) {
+		return false
+	}
+	switch exit.ExitCode() {
+	case 10, 12, 30, 35, 255:
+		return true
+	}
+	return false
+}
+
+// rsyncBytesSent parses the "Total bytes sent: 1,234" line of rsync --stats
+func rsyncBytesSent(stats string) int64 {
+	const prefix = "Total bytes sent:"
+	for _, line := range strings.Split(stats, "\n") {
+		if !strings.HasPrefix(line, prefix) {
+			continue
+		}
+		n := strings.ReplaceAll(strings.TrimSpace(line[len(prefix):]), ",", "")
+		sent, err := strconv.ParseInt(n, 10, 64)
+		if err != nil {
+			return 0
+		}
+		return sent
+	}
+	return 0
+}
+
+// LocalIP returns the IP of the local interface used to reach targetIP
+func LocalIP(targetIP string) (string, error) {
+	// udp doesn't send anything on dial, it only picks the route
+	conn, err := net.Dial("udp", net.JoinHostPort(targetIP, "9"))
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP.String(), nil
+}
+
+// NewID returns a random hex identifier
+func NewID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		// crypto/rand never fails on linux
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// FreeBytes returns the bytes available to unprivileged users on the
+// filesystem holding path, path itself doesn't need to exist yet
+func FreeBytes(path string) (int64, error) {
+	for {
+		var st syscall.Statfs_t
+		err := syscall.Statfs(path, &st)
+		if err == nil {
+			return int64(st.Bavail) * st.Bsize, nil
+		}
+		if !os.IsNotExist(err) || path == filepath.Dir(path) {
+			return 0, err
+		}
+		path = filepath.Dir(path)
+	}
+}
+
+// SetFileTime sets the access and modification times of the open file f to
+// t, unlike os.Chtimes it can't be led elsewhere by a symlink
+func SetFileTime(f *os.File, t time.Time) error {
+	ts := syscall.NsecToTimespec(t.UnixNano())
+	times := [2]syscall.Timespec{ts, ts}
+	// utimensat with no path sets the times of the fd itself
+	_, _, errno := syscall.Syscall6(syscall.SYS_UTIMENSAT, f.Fd(), 0, uintptr(unsafe.Pointer(&times[0])), 0, 0, 0)
+	if errno != 0 {
+		return &os.PathError{Op: "utimensat", Path: f.Name(), Err: errno}
+	}
+	return nil
+}
+
+// ProcessTreeRSS returns the resident memory in bytes of pid and all its
+// descendants
+func ProcessTreeRSS(pid int) (int64, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return 0, err
+	}
+	children := make(map[int][]int)
+	for _, e := range entries {
+		p, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		b, err := os.ReadFile(filepath.Join("/proc", e.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// the command name may contain spaces, fields start after the last ')'
+		fields := strings.Fields(string(b[bytes.LastIndexByte(b, ')')+1:]))
+		if len(fields) < 2 {
+			continue
+		}
+		ppid, err := strconv.Atoi(fields[1])
+		if err != nil {
+			continue
+		}
+		children[ppid] = append(children[ppid], p)
+	}
+
+	var total int64
+	pageSize := int64(os.Getpagesize())
+	queue := []int{pid}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		queue = append(queue, children[p]...)
+		b, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(p), "statm"))
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(b))
+		if len(fields) < 2 {
+			continue
+		}
+		rss, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		total += rss * pageSize
+	}
+	return total, nil
+}
+
+// CommandError is the failure of a child process together with its output
+type CommandError struct {
+	Args   []string
+	Err    error
+	Output string
+}
+
+func (e *CommandError) Error() string {
+	return fmt.Sprintf("%s: %v", strings.Join(e.Args, " "), e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
 }